@@ -0,0 +1,541 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"virel-explorer/html"
+
+	"github.com/virel-project/virel-blockchain/v3/bitcrypto"
+	"github.com/virel-project/virel-blockchain/v3/rpc/daemonrpc"
+	"github.com/virel-project/virel-blockchain/v3/util"
+
+	"github.com/labstack/echo/v4"
+)
+
+// The types below are the JSON schemas of the /api/v1 endpoints. They are kept
+// separate from the template parameters so that the templates can change
+// without breaking API clients. Amounts are in atomic units (see "coin" in the
+// info endpoint) unless the field name says otherwise.
+
+const MAX_API_BLOCK_RANGE = 100
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+type apiInfo struct {
+	Height            uint64 `json:"height"`
+	Difficulty        string `json:"difficulty"`
+	Hashrate          string `json:"hashrate"`
+	TargetBlockTime   uint64 `json:"target_block_time"`
+	BlockReward       uint64 `json:"block_reward"`
+	Coin              uint64 `json:"coin"`
+	CirculatingSupply uint64 `json:"circulating_supply"`
+	TotalSupply       uint64 `json:"total_supply"`
+	MaxSupply         uint64 `json:"max_supply"`
+	SupplyCap         uint64 `json:"supply_cap"`
+	Burned            uint64 `json:"burned"`
+	Stake             uint64 `json:"stake"`
+}
+
+type apiBlock struct {
+	Height       uint64   `json:"height"`
+	Hash         string   `json:"hash"`
+	PrevHash     string   `json:"prev_hash"`
+	Timestamp    uint64   `json:"timestamp"` // unix milliseconds
+	Difficulty   uint64   `json:"difficulty"`
+	Miner        string   `json:"miner"`
+	DelegateId   uint64   `json:"delegate_id"`
+	Delegate     string   `json:"delegate"`
+	Staked       bool     `json:"staked"` // false if the delegate missed the block
+	TotalReward  uint64   `json:"total_reward"`
+	MinerReward  uint64   `json:"miner_reward"`
+	StakerReward uint64   `json:"staker_reward"`
+	SideBlocks   int      `json:"side_blocks"`
+	Transactions []string `json:"transactions"`
+}
+
+// apiBlockEvent is the data of a "block" event of the block stream.
+type apiBlockEvent struct {
+	Height      uint64 `json:"height"`
+	Hash        string `json:"hash"`
+	Timestamp   uint64 `json:"timestamp"` // unix milliseconds
+	Miner       string `json:"miner"`
+	DelegateId  uint64 `json:"delegate_id"`
+	Delegate    string `json:"delegate"`
+	Staked      bool   `json:"staked"`
+	TotalReward uint64 `json:"total_reward"`
+	TxCount     int    `json:"tx_count"`
+}
+
+// apiSuggestion is an entry of /api/search/suggest.
+type apiSuggestion struct {
+	Kind   string `json:"kind"`  // Block, Delegate, Entity or Account
+	Value  string `json:"value"` // height, name, label or address, as typed
+	Detail string `json:"detail,omitempty"`
+	Link   string `json:"link"`
+}
+
+type apiInput struct {
+	Sender string `json:"sender"`
+	Amount uint64 `json:"amount"`
+}
+
+type apiOutput struct {
+	Recipient string `json:"recipient"`
+	PaymentId uint64 `json:"payment_id"`
+	Amount    uint64 `json:"amount"`
+}
+
+type apiTransaction struct {
+	Txid          string      `json:"txid"`
+	Height        uint64      `json:"height"` // 0 while in the mempool
+	Pending       bool        `json:"pending"`
+	Confirmations uint64      `json:"confirmations"`
+	Coinbase      bool        `json:"coinbase"`
+	Signer        string      `json:"signer,omitempty"`
+	TotalAmount   uint64      `json:"total_amount"`
+	Fee           uint64      `json:"fee"`
+	VirtualSize   uint64      `json:"virtual_size"`
+	Inputs        []apiInput  `json:"inputs"`
+	Outputs       []apiOutput `json:"outputs"`
+}
+
+type apiAccountTx struct {
+	Txid   string `json:"txid"`
+	Height uint64 `json:"height"`         // 0 while in the mempool
+	Time   string `json:"time,omitempty"` // UTC, empty if unknown
+	Amount uint64 `json:"amount"`
+}
+
+type apiAccount struct {
+	Address        string         `json:"address"`
+	Balance        uint64         `json:"balance"`
+	LastNonce      uint64         `json:"last_nonce"`
+	MempoolBalance uint64         `json:"mempool_balance"`
+	MempoolNonce   uint64         `json:"mempool_nonce"`
+	PendingNonces  uint64         `json:"pending_nonces"` // transactions of the account in the mempool
+	TransferType   string         `json:"transfer_type"`
+	Page           uint64         `json:"page"`
+	MaxPage        uint64         `json:"max_page"`
+	Transactions   []apiAccountTx `json:"transactions"`
+	Missing        []string       `json:"missing,omitempty"` // txids of the page that could not be fetched in time
+}
+
+type apiUptime struct {
+	Uptime24h         float64 `json:"uptime_24h"`
+	Uptime7d          float64 `json:"uptime_7d"`
+	Uptime30d         float64 `json:"uptime_30d"`
+	Staked30d         uint64  `json:"staked_30d"`
+	Missed30d         uint64  `json:"missed_30d"`
+	LongestMissStreak uint64  `json:"longest_miss_streak"`
+	LastMissedHeight  uint64  `json:"last_missed_height,omitempty"`
+}
+
+type apiDelegateSummary struct {
+	Address       string  `json:"address"`
+	Name          string  `json:"name"`
+	Stake         uint64  `json:"stake"`
+	StakePercent  float64 `json:"stake_percent"`
+	UptimePercent float64 `json:"uptime_percent"` // over 30 days
+	apiUptime
+}
+
+type apiMissedBlock struct {
+	Height    uint64 `json:"height"`
+	Hash      string `json:"hash"`
+	Timestamp int64  `json:"timestamp"` // unix milliseconds
+}
+
+type apiMissedDay struct {
+	Date   string `json:"date"`
+	Staked uint64 `json:"staked"`
+	Missed uint64 `json:"missed"`
+}
+
+type apiMissed struct {
+	Address     string           `json:"address"`
+	Id          uint64           `json:"id"`
+	TotalMissed int              `json:"total_missed"`
+	Missed      []apiMissedBlock `json:"missed"`
+	Days        []apiMissedDay   `json:"days"`
+}
+
+type apiFund struct {
+	Owner  string `json:"owner"`
+	Amount uint64 `json:"amount"`
+	Unlock uint64 `json:"unlock"` // height
+}
+
+type apiDelegate struct {
+	Id      uint64    `json:"id"`
+	Address string    `json:"address"`
+	Owner   string    `json:"owner"`
+	Name    string    `json:"name"`
+	Stake   uint64    `json:"stake"`
+	Funds   []apiFund `json:"funds"`
+	apiUptime
+}
+
+type apiRichListItem struct {
+	Rank    int     `json:"rank"`
+	Address string  `json:"address"`
+	Balance uint64  `json:"balance"`
+	Percent float64 `json:"percent"` // of the circulating supply
+
+	// with ?group=entity, the entity of the row and the number of its
+	// addresses merged in it
+	Entity    string `json:"entity,omitempty"`
+	Addresses int    `json:"addresses,omitempty"`
+}
+
+type apiMarket struct {
+	PriceUSD     float64 `json:"price_usd"`
+	MarketcapUSD float64 `json:"marketcap_usd"`
+	SupplyVRL    float64 `json:"supply_vrl"`
+	Change24h    string  `json:"change_24h"`
+}
+
+type apiStaking struct {
+	Stake            uint64  `json:"stake"`
+	Reward24hPercent float64 `json:"reward_24h_percent"`
+	Reward30dPercent float64 `json:"reward_30d_percent"`
+	Reward60dPercent float64 `json:"reward_60d_percent"`
+	Reward1yPercent  float64 `json:"reward_1y_percent"`
+}
+
+func newAPIInfo(i *html.InfoRes) apiInfo {
+	return apiInfo{
+		Height:            i.Height,
+		Difficulty:        i.Difficulty,
+		Hashrate:          i.Hashrate(),
+		TargetBlockTime:   i.Target,
+		BlockReward:       i.BlockReward,
+		Coin:              i.Coin,
+		CirculatingSupply: i.CirculatingSupply,
+		TotalSupply:       i.TotalSupply,
+		MaxSupply:         i.MaxSupply,
+		SupplyCap:         i.SupplyCap,
+		Burned:            i.Burned,
+		Stake:             i.Stake,
+	}
+}
+
+func newAPIBlock(b *daemonrpc.GetBlockResponse) apiBlock {
+	prev := b.Block.PrevHash()
+	txs := make([]string, len(b.Block.Transactions))
+	for i, v := range b.Block.Transactions {
+		txs[i] = v.String()
+	}
+	return apiBlock{
+		Height:       b.Block.Height,
+		Hash:         b.Hash,
+		PrevHash:     hex.EncodeToString(prev[:]),
+		Timestamp:    b.Block.Timestamp,
+		Difficulty:   b.Block.Difficulty,
+		Miner:        b.Miner,
+		DelegateId:   b.Block.DelegateId,
+		Delegate:     b.Delegate,
+		Staked:       b.Block.StakeSignature != bitcrypto.BlankSignature,
+		TotalReward:  b.TotalReward,
+		MinerReward:  b.MinerReward,
+		StakerReward: b.StakerReward,
+		SideBlocks:   len(b.Block.SideBlocks),
+		Transactions: txs,
+	}
+}
+
+func newAPIBlockEvent(b *daemonrpc.GetBlockResponse) apiBlockEvent {
+	return apiBlockEvent{
+		Height:      b.Block.Height,
+		Hash:        b.Hash,
+		Timestamp:   b.Block.Timestamp,
+		Miner:       b.Miner,
+		DelegateId:  b.Block.DelegateId,
+		Delegate:    b.Delegate,
+		Staked:      b.Block.StakeSignature != bitcrypto.BlankSignature,
+		TotalReward: b.TotalReward,
+		TxCount:     len(b.Block.Transactions),
+	}
+}
+
+func newAPITransaction(p html.TransactionParams) apiTransaction {
+	tx := apiTransaction{
+		Txid:          p.Txid,
+		Height:        p.Tx.Height,
+		Pending:       p.Pending(),
+		Confirmations: p.Confs,
+		Coinbase:      p.Tx.Coinbase,
+		TotalAmount:   p.Tx.TotalAmount,
+		Fee:           p.Tx.Fee,
+		VirtualSize:   p.Tx.VirtualSize,
+		Inputs:        make([]apiInput, len(p.Tx.Inputs)),
+		Outputs:       make([]apiOutput, len(p.Tx.Outputs)),
+	}
+	if p.Tx.Signer != nil {
+		tx.Signer = p.Tx.Signer.Addr.String()
+	}
+	for i, v := range p.Tx.Inputs {
+		tx.Inputs[i] = apiInput{Sender: v.Sender.String(), Amount: v.Amount}
+	}
+	for i, v := range p.Tx.Outputs {
+		tx.Outputs[i] = apiOutput{Recipient: v.Recipient.String(), PaymentId: v.PaymentId, Amount: v.Amount}
+	}
+	return tx
+}
+
+func newAPIAccount(p html.AddressParams) apiAccount {
+	acc := apiAccount{
+		Address:        p.Address,
+		Balance:        p.Info.Balance,
+		LastNonce:      p.Info.LastNonce,
+		MempoolBalance: p.Info.MempoolBalance,
+		MempoolNonce:   p.Info.MempoolNonce,
+		PendingNonces:  p.PendingNonces(),
+		TransferType:   p.TransferType,
+		Page:           p.Page,
+		MaxPage:        p.MaxPage,
+		Transactions:   make([]apiAccountTx, len(p.TxList)),
+		Missing:        p.MissingTxids,
+	}
+	for i, v := range p.TxList {
+		acc.Transactions[i] = apiAccountTx{
+			Txid:   v.Txid,
+			Height: v.Tx.Height,
+			Time:   p.BlockTimes[v.Tx.Height],
+			Amount: v.Amount,
+		}
+	}
+	return acc
+}
+
+func newAPIUptime(u html.DelegateUptime) apiUptime {
+	return apiUptime{
+		Uptime24h:         u.Day.Percent,
+		Uptime7d:          u.Week.Percent,
+		Uptime30d:         u.Month.Percent,
+		Staked30d:         u.Month.Staked,
+		Missed30d:         u.Month.Missed,
+		LongestMissStreak: u.LongestMissStreak,
+		LastMissedHeight:  u.LastMissedHeight,
+	}
+}
+
+func newAPIMissed(p *html.MissedParams) apiMissed {
+	m := apiMissed{
+		Address:     p.Address,
+		Id:          p.Id,
+		TotalMissed: p.TotalMissed,
+		Missed:      make([]apiMissedBlock, len(p.Missed)),
+		Days:        make([]apiMissedDay, len(p.Days)),
+	}
+	for i, v := range p.Missed {
+		m.Missed[i] = apiMissedBlock{Height: v.Height, Hash: v.Hash}
+		if !v.Time.IsZero() {
+			m.Missed[i].Timestamp = v.Time.UnixMilli()
+		}
+	}
+	for i, v := range p.Days {
+		m.Days[i] = apiMissedDay(v)
+	}
+	return m
+}
+
+func newAPIDelegate(p *html.DelegateParams) apiDelegate {
+	d := apiDelegate{
+		Id:      p.Info.Id,
+		Address: p.Address,
+		Owner:   p.Info.Owner.String(),
+		Name:    p.Info.Name,
+		Stake:   p.Info.TotalAmount,
+		Funds:   make([]apiFund, len(p.Funds)),
+
+		apiUptime: newAPIUptime(p.Uptime),
+	}
+	for i, v := range p.Funds {
+		d.Funds[i] = apiFund{Owner: v.Owner.String(), Amount: v.Amount, Unlock: v.Unlock}
+	}
+	return d
+}
+
+func registerAPI(g *echo.Group, ex *Explorer) {
+	g.GET("/info", func(c echo.Context) error {
+		info, err := ex.info()
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, newAPIInfo(info))
+	})
+
+	// blocks?start=<height>&end=<height>, both inclusive. Defaults to the
+	// latest blocks.
+	g.GET("/blocks", func(c echo.Context) error {
+		info, err := ex.info()
+		if err != nil {
+			return err
+		}
+
+		end := info.Height
+		if v := c.QueryParam("end"); v != "" {
+			if end, err = strconv.ParseUint(v, 10, 64); err != nil {
+				return fmt.Errorf("%w: invalid end height", errBadInput)
+			}
+		}
+		end = min(end, info.Height)
+		start := end - min(end, 19)
+		if v := c.QueryParam("start"); v != "" {
+			if start, err = strconv.ParseUint(v, 10, 64); err != nil {
+				return fmt.Errorf("%w: invalid start height", errBadInput)
+			}
+		}
+		if start > end {
+			return fmt.Errorf("%w: start is above end", errBadInput)
+		}
+		if end-start >= MAX_API_BLOCK_RANGE {
+			return fmt.Errorf("%w: range too large, the maximum is %d", errBadInput, MAX_API_BLOCK_RANGE)
+		}
+
+		blocks := make([]apiBlock, 0, end-start+1)
+		for h := end; h >= start; h-- {
+			bl, err := ex.indexer.BlockByHeight(h)
+			if err != nil {
+				return err
+			}
+			blocks = append(blocks, newAPIBlock(bl))
+			if h == 0 {
+				break
+			}
+		}
+		return c.JSON(http.StatusOK, blocks)
+	})
+	g.GET("/blocks/:bl", func(c echo.Context) error {
+		bl, err := ex.FindBlock(c.Param("bl"))
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, newAPIBlock(bl))
+	})
+	g.GET("/stream/blocks", func(c echo.Context) error {
+		return streamBlocks(c, ex.blocks)
+	})
+
+	g.GET("/transactions/:txid", func(c echo.Context) error {
+		txid := c.Param("txid")
+		if len(txid) != 32*2 || !util.IsHex(txid) {
+			return fmt.Errorf("%w: invalid transaction id", errBadInput)
+		}
+		id, _ := hex.DecodeString(txid)
+
+		p, err := ex.TransactionData(util.Hash(id))
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, newAPITransaction(p))
+	})
+
+	// accounts/:addr?transfer_type=incoming|outgoing&page=<n>
+	g.GET("/accounts/:addr", func(c echo.Context) error {
+		var page uint64
+		if v := c.QueryParam("page"); v != "" {
+			n, err := strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				return fmt.Errorf("%w: invalid page", errBadInput)
+			}
+			page = n
+		}
+
+		p, err := ex.AccountData(c.Request().Context(), c.Param("addr"), c.QueryParam("transfer_type"), page)
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, newAPIAccount(p))
+	})
+
+	g.GET("/delegates", func(c echo.Context) error {
+		p, err := ex.DelegatesData()
+		if err != nil {
+			return err
+		}
+
+		out := make([]apiDelegateSummary, len(p.Delegates))
+		for i, v := range p.Delegates {
+			out[i] = apiDelegateSummary{
+				Address:       v.Address,
+				Name:          v.Description,
+				Stake:         v.TotalAmount,
+				StakePercent:  v.BalancePercent,
+				UptimePercent: v.UptimePercent,
+
+				apiUptime: newAPIUptime(v.Uptime),
+			}
+		}
+		return c.JSON(http.StatusOK, out)
+	})
+	g.GET("/delegates/:id", func(c echo.Context) error {
+		p, err := ex.DelegateData(c.Param("id"))
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, newAPIDelegate(p))
+	})
+
+	g.GET("/delegates/:id/missed", func(c echo.Context) error {
+		p, err := ex.MissedData(c.Param("id"))
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, newAPIMissed(p))
+	})
+
+	// richlist?group=entity merges the addresses of each entity
+	g.GET("/richlist", func(c echo.Context) error {
+		p, err := ex.StatsData(c.QueryParam("group") == "entity")
+		if err != nil {
+			return err
+		}
+
+		out := make([]apiRichListItem, len(p.RichList))
+		for i, v := range p.RichList {
+			out[i] = apiRichListItem{
+				Rank:    v.Rank,
+				Address: v.Address,
+				Balance: v.Total,
+				Percent: v.Percent,
+			}
+			if v.Entity != nil {
+				out[i].Entity = v.Entity.Slug
+				out[i].Addresses = v.Addresses
+			}
+		}
+		return c.JSON(http.StatusOK, out)
+	})
+
+	g.GET("/market", func(c echo.Context) error {
+		mkt := ex.updater.Get().MarketInfo
+		if mkt == nil {
+			return c.JSON(http.StatusServiceUnavailable, apiError{Error: "market data not available yet"})
+		}
+		return c.JSON(http.StatusOK, apiMarket{
+			PriceUSD:     mkt.Price,
+			MarketcapUSD: mkt.Marketcap,
+			SupplyVRL:    mkt.Supply,
+			Change24h:    mkt.Change,
+		})
+	})
+
+	g.GET("/staking", func(c echo.Context) error {
+		p, err := ex.StakingData()
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, apiStaking{
+			Stake:            p.Info.Stake,
+			Reward24hPercent: p.Reward24h,
+			Reward30dPercent: p.Reward30d,
+			Reward60dPercent: p.Reward60d,
+			Reward1yPercent:  p.Reward1y,
+		})
+	})
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"virel-explorer/html"
+	"virel-explorer/index"
+	eutil "virel-explorer/util"
+
+	"github.com/virel-project/virel-blockchain/v3/rpc/daemonrpc"
+)
+
+const (
+	BACKFILL_CHUNK   = 500 // blocks fetched, counted and saved at once
+	BACKFILL_WORKERS = 8
+)
+
+// BackfillProgress returns the progress of the uptime backfill.
+func (b *Blocks) BackfillProgress() html.BackfillProgress {
+	b.mut.RLock()
+	defer b.mut.RUnlock()
+	return b.backfill
+}
+
+// planBackfill decides which blocks the updater has not seen and will not
+// see, up to MAX_BLOCKS_HISTORY blocks below the tip, so that the uptime is
+// meaningful while the updater follows the tip from there. Without saved state
+// it starts b.window blocks below the tip; otherwise it resumes after the
+// saved height, or where an interrupted backfill stopped.
+func (b *Blocks) planBackfill() error {
+	tip, err := b.tip.Get()
+	if err != nil {
+		return err
+	}
+	if tip.Info.Height <= MAX_BLOCKS_HISTORY {
+		return nil
+	}
+	target := tip.Info.Height - MAX_BLOCKS_HISTORY
+
+	b.mut.Lock()
+	defer b.mut.Unlock()
+
+	// blocks between the saved height and target; 0 means that the updater
+	// has not started
+	var start, end uint64
+	if start = b.height; start == 0 && b.window > 0 {
+		start = max(tip.Info.Height-min(b.window, tip.Info.Height-1)-1, 1)
+	}
+	if start != 0 && start < target {
+		end = target
+	}
+	// and the rest of an interrupted backfill
+	if p := b.pending; p != nil && p.Height < p.Target {
+		if end == 0 {
+			start, end = p.Height, p.Target
+		} else {
+			start, end = min(start, p.Height), max(end, p.Target)
+		}
+	}
+	if end == 0 {
+		b.pending = nil
+		return nil
+	}
+
+	// the updater takes over at target while the range below is scanned
+	b.pending = &backfillState{Height: start, Target: end}
+	b.height = max(b.height, target)
+	b.backfill = html.BackfillProgress{Total: end - start}
+	b.saveDelegates()
+	return nil
+}
+
+// backfillHistory counts the blocks planned by planBackfill, saving its
+// progress after each chunk so that a restart resumes it.
+func (b *Blocks) backfillHistory(ctx context.Context) error {
+	b.mut.RLock()
+	if b.pending == nil {
+		b.mut.RUnlock()
+		return nil
+	}
+	start, target := b.pending.Height, b.pending.Target
+	total := b.backfill.Total
+	b.mut.RUnlock()
+
+	b.log.Info("backfilling delegate uptime", "from", start+1, "to", target, "blocks", target-start)
+
+	for h := start + 1; h <= target; h += BACKFILL_CHUNK {
+		heights := make([]uint64, 0, BACKFILL_CHUNK)
+		for i := h; i <= target && i < h+BACKFILL_CHUNK; i++ {
+			heights = append(heights, i)
+		}
+
+		results := eutil.FetchAll(ctx, heights, BACKFILL_WORKERS, func(height uint64) (*daemonrpc.GetBlockResponse, error) {
+			return b.client.GetBlockByHeight(daemonrpc.GetBlockByHeightRequest{Height: height})
+		})
+		for _, r := range results {
+			if r.Err != nil {
+				return r.Err
+			}
+		}
+
+		b.mut.Lock()
+		records := make([]index.Participation, 0, len(results))
+		for _, r := range results {
+			if p, ok := b.participation(r.Value); ok {
+				records = append(records, p)
+			}
+		}
+		if err := b.db.PutParticipation(records...); err != nil {
+			b.mut.Unlock()
+			return err
+		}
+		last := heights[len(heights)-1]
+		b.pending.Height = last
+		b.backfill.Done = total - (target - last)
+		if last == target {
+			b.pending = nil
+		}
+		b.saveDelegates()
+		b.mut.Unlock()
+
+		b.log.Info("backfill progress", "height", last, "done", last-start, "total", target-start)
+	}
+
+	if target > UPTIME_RETENTION {
+		if err := b.db.PruneParticipation(target - UPTIME_RETENTION); err != nil {
+			return err
+		}
+	}
+
+	b.log.Info("backfill done", "blocks", target-start)
+	return nil
+}
@@ -1,56 +1,118 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"encoding/hex"
 	"fmt"
-	"os"
+	"log/slog"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
+	"virel-explorer/html"
+	"virel-explorer/index"
 
 	"github.com/virel-project/virel-blockchain/v3/bitcrypto"
-	"github.com/virel-project/virel-blockchain/v3/config"
 	"github.com/virel-project/virel-blockchain/v3/rpc/daemonrpc"
 )
 
+const MAX_REORGS_HISTORY = 50
+
 type Blocks struct {
 	mut            sync.RWMutex
-	client         *daemonrpc.RpcClient
+	client         *DaemonPool
+	tip            *TipService
+	db             *index.DB // participation records
 	blocks         []*daemonrpc.GetBlockResponse
+	reorgs         []*html.ReorgInfo
 	KnownDelegates []*KnownDelegate
+	delegateCount  atomic.Int64 // len(KnownDelegates), readable without mut
 	height         uint64
+	delegatesPath  string
+	log            *slog.Logger
+
+	// subscribers to new blocks and reorgs, see Subscribe
+	subs   map[chan BlockEvent]struct{}
+	closed bool
+
+	// blocks scanned when starting without saved state, and the progress of
+	// the scan
+	window   uint64
+	pending  *backfillState
+	backfill html.BackfillProgress
 }
 
-func NewBlocks(cl *daemonrpc.RpcClient) *Blocks {
+// NewBlocks creates the block updater, resuming the delegate tracking saved in
+// delegatesPath. Without saved state, the last window blocks are scanned to
+// rebuild the participation records.
+func NewBlocks(cl *DaemonPool, tip *TipService, db *index.DB, delegatesPath string, window uint64) (*Blocks, error) {
 	b := &Blocks{
 		client:         cl,
+		tip:            tip,
+		db:             db,
+		delegatesPath:  delegatesPath,
+		window:         window,
 		blocks:         make([]*daemonrpc.GetBlockResponse, 0),
 		KnownDelegates: make([]*KnownDelegate, 0),
+		log:            slog.With("component", "updater"),
+		subs:           make(map[chan BlockEvent]struct{}),
 	}
 
-	delegates, err := os.ReadFile("delegates.json")
+	st, err := loadDelegates(b.delegatesPath)
 	if err != nil {
-		fmt.Println(err)
-		return b
+		return nil, fmt.Errorf("failed to load delegates: %w", err)
 	}
-
-	err = json.Unmarshal(delegates, &b.KnownDelegates)
-	if err != nil {
-		fmt.Println(err)
-		return b
+	for _, v := range st.Delegates {
+		if v != nil {
+			b.KnownDelegates = append(b.KnownDelegates, v)
+		}
+	}
+	b.delegateCount.Store(int64(len(b.KnownDelegates)))
+	// resume right after the last counted block
+	b.height = st.Height
+	b.pending = st.Backfill
+	if st.Height != 0 {
+		b.log.Info("resuming delegate tracking", "height", st.Height, "delegates", len(b.KnownDelegates))
 	}
 
-	return b
+	return b, nil
 }
 
-func (bl *Blocks) Updater() {
+// Updater follows the chain tip until ctx is done, while the past blocks are
+// backfilled alongside.
+func (bl *Blocks) Updater(ctx context.Context) {
+	for ctx.Err() == nil {
+		err := bl.planBackfill()
+		if err == nil {
+			break
+		}
+		bl.log.Error("failed to plan the delegate uptime backfill", "err", err)
+		sleep(ctx, 10*time.Second)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for ctx.Err() == nil {
+			err := bl.backfillHistory(ctx)
+			if err == nil {
+				return
+			}
+			bl.log.Error("failed to backfill delegate uptime", "err", err)
+			sleep(ctx, 10*time.Second)
+		}
+	}()
+	defer wg.Wait()
+
 	var adj float64
 	var n float64
-	for {
+	for ctx.Err() == nil {
 		bl.mut.Lock()
 		updated, adj2, err := bl.update(adj)
 		bl.mut.Unlock()
 		if err != nil {
-			fmt.Println("failed to update:", err)
+			bl.log.Error("failed to update", "err", err)
 		}
 		if adj != adj2 {
 			n = min(n+1, 100)
@@ -60,26 +122,49 @@ func (bl *Blocks) Updater() {
 				adj = (adj*n + adj2) / (n + 1)
 			}
 			adj = min(max(adj, -30_000), 30_000) // limit timestamp adjustment to 30 seconds
-			fmt.Println("adj2:", adj2, "adj:", adj)
+			bl.log.Debug("clock adjustment", "sample_ms", adj2, "adjustment_ms", adj)
+			clockAdjustment.Set(adj)
 		}
 		if !updated {
-			time.Sleep(2 * time.Second)
+			sleep(ctx, 2*time.Second)
 		}
 	}
+
+	bl.mut.Lock()
+	bl.closeSubscribers()
+	bl.mut.Unlock()
 }
 func (b *Blocks) GetList() []*daemonrpc.GetBlockResponse {
 	b.mut.RLock()
 	defer b.mut.RUnlock()
 
-	fmt.Println("average block time:", float64(b.blocks[0].Block.Timestamp-b.blocks[len(b.blocks)-1].Block.Timestamp)/float64(len(b.blocks))/1000, "s")
-
 	return b.blocks
 }
-func (b *Blocks) GetDelegates() []*KnownDelegate {
+
+// DelegateCount returns the number of known delegates. Unlike GetDelegates, it
+// does not wait for an update in progress.
+func (b *Blocks) DelegateCount() int {
+	return int(b.delegateCount.Load())
+}
+
+// GetDelegates returns a copy of the known delegates.
+func (b *Blocks) GetDelegates() []KnownDelegate {
+	b.mut.RLock()
+	defer b.mut.RUnlock()
+
+	out := make([]KnownDelegate, len(b.KnownDelegates))
+	for i, v := range b.KnownDelegates {
+		out[i] = *v
+	}
+	return out
+}
+
+// GetReorgs returns the recent chain reorganisations, newest first.
+func (b *Blocks) GetReorgs() []*html.ReorgInfo {
 	b.mut.RLock()
 	defer b.mut.RUnlock()
 
-	return b.KnownDelegates
+	return slices.Clone(b.reorgs)
 }
 func (b *Blocks) update(adj float64) (bool, float64, error) {
 	info, err := b.client.GetInfo(daemonrpc.GetInfoRequest{})
@@ -96,63 +181,176 @@ func (b *Blocks) update(adj float64) (bool, float64, error) {
 	if b.height < info.Height {
 		b.height++
 
-		adj := float64(0)
-
 		bl, err := b.client.GetBlockByHeight(daemonrpc.GetBlockByHeightRequest{
 			Height: b.height,
 		})
 		if err != nil {
+			b.height--
 			return false, adj, err
 		}
 
-		if bl.Block.DelegateId != 0 {
-			var deleg *KnownDelegate
-			for _, v := range b.KnownDelegates {
-				if v.Id == bl.Block.DelegateId {
-					deleg = v
-				}
+		if len(b.blocks) > 0 && b.blocks[0].Block.Height == b.height-1 {
+			prev := bl.Block.PrevHash()
+			if hex.EncodeToString(prev[:]) != b.blocks[0].Hash {
+				b.height--
+				b.tip.Notify()
+				return true, adj, b.rollback(bl)
 			}
-			if deleg == nil {
-				deleg = &KnownDelegate{
-					Id: bl.Block.DelegateId,
-				}
-				b.KnownDelegates = append(b.KnownDelegates, deleg)
+		}
+
+		if p, ok := b.participation(bl); ok {
+			if err := b.db.PutParticipation(p); err != nil {
+				b.height--
+				return false, adj, err
 			}
-			if deleg.LastHeight < bl.Block.Height {
-				deleg.LastHeight = bl.Block.Height
-				if bl.Block.StakeSignature == bitcrypto.BlankSignature {
-					deleg.BlocksMissed++
-				} else {
-					deleg.BlocksStaked++
-				}
-
-				if deleg.BlocksMissed+deleg.BlocksStaked > 3*config.BLOCKS_PER_DAY {
-					deleg.BlocksMissed /= 2
-					deleg.BlocksStaked /= 2
-				}
-
-				delegs, err := json.Marshal(b.KnownDelegates)
-				if err != nil {
-					fmt.Println(err)
-				} else {
-					err = os.WriteFile("delegates.json", delegs, 0o660)
-					if err != nil {
-						fmt.Println(err)
-					}
-				}
+			b.saveDelegates()
+		}
+		if b.height%1000 == 0 && b.height > UPTIME_RETENTION {
+			if err := b.db.PruneParticipation(b.height - UPTIME_RETENTION); err != nil {
+				b.log.Error("failed to prune participation records", "err", err)
 			}
 		}
 
+		adj := float64(0)
 		if b.height == info.Height {
 			adj = float64(bl.Block.Timestamp) - float64(time.Now().UnixMilli())
 		}
 		bl.Block.Timestamp = uint64(float64(bl.Block.Timestamp) - adj)
+		if b.height == info.Height {
+			b.tip.Publish(info, bl)
+		}
 
 		b.blocks = append([]*daemonrpc.GetBlockResponse{bl}, b.blocks...)
 		if len(b.blocks) > MAX_BLOCKS_HISTORY {
 			b.blocks = b.blocks[:len(b.blocks)-1]
 		}
+		b.publish(BlockEvent{Block: bl})
 		return true, adj, nil
 	}
 	return false, adj, nil
 }
+
+// participation returns the participation record of a block, and records its
+// delegate as known. Blocks without a delegate have no record.
+func (b *Blocks) participation(bl *daemonrpc.GetBlockResponse) (index.Participation, bool) {
+	if bl.Block.DelegateId == 0 {
+		return index.Participation{}, false
+	}
+	deleg := b.delegate(bl.Block.DelegateId)
+	if deleg == nil {
+		deleg = &KnownDelegate{
+			Id: bl.Block.DelegateId,
+		}
+		b.KnownDelegates = append(b.KnownDelegates, deleg)
+		b.delegateCount.Store(int64(len(b.KnownDelegates)))
+	}
+	deleg.LastHeight = max(deleg.LastHeight, bl.Block.Height)
+
+	p := index.Participation{
+		Height:    bl.Block.Height,
+		Delegate:  bl.Block.DelegateId,
+		Missed:    bl.Block.StakeSignature == bitcrypto.BlankSignature,
+		Timestamp: bl.Block.Timestamp,
+	}
+	hex.Decode(p.Hash[:], []byte(bl.Hash))
+	return p, true
+}
+
+func (b *Blocks) delegate(id uint64) *KnownDelegate {
+	for _, v := range b.KnownDelegates {
+		if v.Id == id {
+			return v
+		}
+	}
+	return nil
+}
+
+// Flush writes the delegate state to disk.
+func (b *Blocks) Flush() {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	b.saveDelegates()
+}
+
+func (b *Blocks) saveDelegates() {
+	st := &delegatesState{
+		Version:   DELEGATES_STATE_VERSION,
+		Height:    b.height,
+		Delegates: b.KnownDelegates,
+		Backfill:  b.pending,
+	}
+	if err := st.save(b.delegatesPath); err != nil {
+		b.log.Error("failed to save delegates", "err", err)
+	}
+}
+
+// rollback handles a block whose parent is not the last stored block: it walks
+// back through the stored blocks until one matches the daemon's chain again,
+// and drops the participation records of every block above it.
+func (b *Blocks) rollback(newTip *daemonrpc.GetBlockResponse) error {
+	oldTip := b.blocks[0]
+
+	for len(b.blocks) > 0 {
+		stored := b.blocks[0]
+		bl, err := b.client.GetBlockByHeight(daemonrpc.GetBlockByHeightRequest{
+			Height: stored.Block.Height,
+		})
+		if err != nil {
+			return err
+		}
+		if bl.Hash == stored.Hash {
+			break
+		}
+
+		b.blocks = b.blocks[1:]
+		b.height = stored.Block.Height - 1
+	}
+
+	depth := oldTip.Block.Height - b.height
+	if depth == 0 {
+		// our tip is still on the daemon's chain, which changed between the
+		// two calls of update: the next one fetches the new block again
+		return nil
+	}
+	if len(b.blocks) == 0 {
+		b.log.Warn("reorg deeper than the block history, fork point unknown", "history", MAX_BLOCKS_HISTORY)
+	}
+	b.log.Warn("reorg detected", "fork_height", b.height, "depth", depth)
+
+	if err := b.db.DeleteParticipation(b.height + 1); err != nil {
+		return err
+	}
+	var orphaned []uint64
+	for _, v := range b.KnownDelegates {
+		if v.LastHeight > b.height {
+			orphaned = append(orphaned, v.Id)
+		}
+	}
+	if len(orphaned) > 0 {
+		last, err := b.db.LastParticipation(b.height+1, orphaned...)
+		if err != nil {
+			return err
+		}
+		for _, v := range b.KnownDelegates {
+			if v.LastHeight > b.height {
+				v.LastHeight = last[v.Id]
+			}
+		}
+	}
+
+	b.reorgs = append([]*html.ReorgInfo{{
+		Time:       time.Now(),
+		ForkHeight: b.height,
+		Depth:      depth,
+		OldTip:     oldTip.Hash,
+		NewTip:     newTip.Hash,
+	}}, b.reorgs...)
+	if len(b.reorgs) > MAX_REORGS_HISTORY {
+		b.reorgs = b.reorgs[:MAX_REORGS_HISTORY]
+	}
+	b.publish(BlockEvent{Reorg: b.reorgs[0]})
+
+	b.saveDelegates()
+
+	return nil
+}
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+	"virel-explorer/html"
+	eutil "virel-explorer/util"
+
+	"github.com/virel-project/virel-blockchain/v3/address"
+	"github.com/virel-project/virel-blockchain/v3/chaintype"
+	"github.com/virel-project/virel-blockchain/v3/config"
+	"github.com/virel-project/virel-blockchain/v3/rpc/daemonrpc"
+	"github.com/virel-project/virel-blockchain/v3/util"
+)
+
+const (
+	ACCOUNT_FETCH_TIMEOUT   = 5 * time.Second
+	ACCOUNT_FETCH_WORKERS   = 8
+	TX_CACHE_SIZE           = 10000
+	BLOCK_TIME_CACHE_SIZE   = 10000
+	CACHE_MIN_CONFIRMATIONS = 10 // confirmations after which a transaction or block is cached
+)
+
+// Explorer gathers the data shown by the explorer pages. Both the HTML pages
+// and the JSON API are built from it.
+type Explorer struct {
+	client    *DaemonPool
+	tip       *TipService
+	blocks    *Blocks
+	delegates *DelegateService
+	updater   *Updater
+	indexer   *Indexer
+
+	txCache    *eutil.LRU[util.Hash, *daemonrpc.GetTransactionResponse]
+	blockTimes *eutil.LRU[uint64, string]      // formatted block timestamps by height
+	mined      *eutil.LRU[string, *minedCache] // blocks mined by pools, by slug
+}
+
+// info returns the daemon info of the current tip snapshot. It is shared
+// between requests and must not be modified.
+func (ex *Explorer) info() (*html.InfoRes, error) {
+	tip, err := ex.tip.Get()
+	if err != nil {
+		return nil, err
+	}
+	return (*html.InfoRes)(tip.Info), nil
+}
+
+func (ex *Explorer) IndexData() (html.IndexParams, error) {
+	info, err := ex.info()
+	if err != nil {
+		return html.IndexParams{}, err
+	}
+
+	// the block updater may already be past the snapshot
+	blocks := ex.blocks.GetList()
+	for len(blocks) > 0 && blocks[0].Block.Height > info.Height {
+		blocks = blocks[1:]
+	}
+
+	return html.IndexParams{
+		Info:   info,
+		Blocks: blocks,
+	}, nil
+}
+
+// StatsData returns the network stats and the rich list. If grouped, the
+// addresses of a same entity are merged into one row.
+func (ex *Explorer) StatsData(grouped bool) (html.StatsParams, error) {
+	updaterOut := ex.updater.Get()
+
+	percent := func(total uint64) float64 {
+		if updaterOut.MarketInfo == nil || updaterOut.MarketInfo.Supply == 0 {
+			return 0
+		}
+		return float64(total) / config.COIN / float64(updaterOut.MarketInfo.Supply) * 100
+	}
+
+	items := make([]html.RichListItem, 0, len(updaterOut.RichList))
+	rows := make(map[string]int) // entity slug -> index in items
+	for _, st := range updaterOut.RichList {
+		e := html.LookupEntity(st.Address)
+		if grouped && e != nil {
+			if i, ok := rows[e.Slug]; ok {
+				items[i].Total += st.Total()
+				items[i].Addresses++
+				continue
+			}
+			rows[e.Slug] = len(items)
+		}
+
+		item := html.RichListItem{
+			Address:   st.Address,
+			Total:     st.Total(),
+			Addresses: 1,
+		}
+		if grouped {
+			item.Entity = e
+		}
+		items = append(items, item)
+	}
+
+	if grouped {
+		slices.SortStableFunc(items, func(a, b html.RichListItem) int {
+			return cmp.Compare(b.Total, a.Total)
+		})
+	}
+	for i := range items {
+		items[i].Rank = i + 1
+		items[i].Balance = float64(items[i].Total) / config.COIN
+		items[i].Percent = percent(items[i].Total)
+	}
+
+	info, err := ex.info()
+	if err != nil {
+		return html.StatsParams{}, err
+	}
+
+	return html.StatsParams{
+		RichList: items,
+		Grouped:  grouped,
+		Market:   updaterOut.MarketInfo,
+		Info:     info,
+	}, nil
+}
+
+func (ex *Explorer) StakingData() (html.StakingParams, error) {
+	ir, err := ex.info()
+	if err != nil {
+		return html.StakingParams{}, err
+	}
+
+	stake := float64(ir.Stake) / config.COIN
+
+	reward24h := GetStakeReward(ir.Height, config.BLOCKS_PER_DAY) / stake
+	reward30d := GetStakeReward(ir.Height, 30*config.BLOCKS_PER_DAY) / stake
+	reward60d := GetStakeReward(ir.Height, 60*config.BLOCKS_PER_DAY) / stake
+	reward1y := GetStakeReward(ir.Height, 365*config.BLOCKS_PER_DAY) / stake
+
+	return html.StakingParams{
+		Info:      ir,
+		Reward24h: math.Round(reward24h*10000) / 100,
+		Reward30d: math.Round(reward30d*10000) / 100,
+		Reward60d: math.Round(reward60d*10000) / 100,
+		Reward1y:  math.Round(reward1y*10000) / 100,
+	}, nil
+}
+
+func (ex *Explorer) DelegatesData() (html.DelegatesParams, error) {
+	delegs, fetchedAt := ex.delegates.Get()
+
+	return html.DelegatesParams{
+		Delegates: delegs,
+		FetchedAt: fetchedAt,
+		Loading:   fetchedAt.IsZero(),
+		Backfill:  ex.blocks.BackfillProgress(),
+	}, nil
+}
+
+// delegate returns the record of a delegate given by address ("delegate12")
+// or by id ("12"), named as on the delegate list.
+func (ex *Explorer) delegate(delid string) (*daemonrpc.GetDelegateResponse, error) {
+	if len(delid) > 0 && delid[0] != 'd' {
+		delid = "delegate" + delid
+	}
+
+	deleg, err := ex.client.GetDelegate(daemonrpc.GetDelegateRequest{
+		DelegateAddress: delid,
+	})
+	if err != nil {
+		return nil, lookupError(err, "delegate "+delid)
+	}
+	deleg.Name = delegateName(deleg.Id, deleg.Name)
+	return deleg, nil
+}
+
+// DelegateData returns a delegate by address ("delegate12") or by id ("12").
+func (ex *Explorer) DelegateData(delid string) (*html.DelegateParams, error) {
+	info, err := ex.info()
+	if err != nil {
+		return nil, err
+	}
+
+	deleg, err := ex.delegate(delid)
+	if err != nil {
+		return nil, err
+	}
+
+	slices.SortStableFunc(deleg.Funds, func(a, b *chaintype.DelegatedFund) int {
+		return cmp.Compare(b.Amount, a.Amount)
+	})
+
+	funds := make([]*html.Fund, len(deleg.Funds))
+	for i, v := range deleg.Funds {
+		funds[i] = &html.Fund{
+			Owner:  v.Owner,
+			Amount: v.Amount,
+			Unlock: v.Unlock,
+		}
+	}
+
+	return &html.DelegateParams{
+		Address: deleg.Address.String(),
+		Info:    deleg,
+		Height:  info.Height,
+		Funds:   funds,
+		Uptime:  ex.delegates.Uptime(deleg.Id),
+	}, nil
+}
+
+// MissedData returns the blocks missed by a delegate, given by address or id
+// as for DelegateData.
+func (ex *Explorer) MissedData(delid string) (*html.MissedParams, error) {
+	info, err := ex.info()
+	if err != nil {
+		return nil, err
+	}
+
+	deleg, err := ex.delegate(delid)
+	if err != nil {
+		return nil, err
+	}
+
+	missed, days, err := delegateMissed(ex.blocks.db, deleg.Id, info.Height, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	p := &html.MissedParams{
+		Address:     deleg.Address.String(),
+		Id:          deleg.Id,
+		Name:        deleg.Name,
+		TotalMissed: len(missed),
+		Missed:      missed,
+		Days:        days,
+	}
+	if len(p.Missed) > MAX_MISSED_LIST {
+		p.Missed = p.Missed[:MAX_MISSED_LIST]
+	}
+	return p, nil
+}
+
+// FindBlock returns a block by hex hash or by height.
+func (ex *Explorer) FindBlock(bl string) (*daemonrpc.GetBlockResponse, error) {
+	var res *daemonrpc.GetBlockResponse
+	var err error
+	if len(bl) == 64 {
+		var hash []byte
+		hash, err = hex.DecodeString(bl)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid block hash %q", errBadInput, bl)
+		}
+
+		res, err = ex.indexer.BlockByHash(util.Hash(hash))
+	} else {
+		var height uint64
+		height, err = strconv.ParseUint(bl, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid block height or hash %q", errBadInput, bl)
+		}
+
+		res, err = ex.indexer.BlockByHeight(height)
+	}
+	if err != nil {
+		return nil, lookupError(err, "block "+bl)
+	}
+	return res, nil
+}
+
+func (ex *Explorer) BlockData(bl string) (html.BlockParams, error) {
+	res, err := ex.FindBlock(bl)
+	if err != nil {
+		return html.BlockParams{}, err
+	}
+	info, err := ex.info()
+	if err != nil {
+		return html.BlockParams{}, err
+	}
+
+	return html.BlockParams{
+		Block: (*html.BlockRes)(res),
+		Info:  (*daemonrpc.GetInfoResponse)(info),
+	}, nil
+}
+
+func (ex *Explorer) TransactionData(id util.Hash) (html.TransactionParams, error) {
+	res, err := ex.indexer.Transaction(id)
+	if err != nil {
+		return html.TransactionParams{}, lookupError(err, "transaction "+id.String())
+	}
+
+	info, err := ex.info()
+	if err != nil {
+		return html.TransactionParams{}, err
+	}
+	height := info.Height
+
+	var confs uint64 = 0
+	if res.Height != 0 && res.Height <= height {
+		confs = height - res.Height + 1
+	}
+
+	return html.TransactionParams{
+		Tx:    res,
+		Txid:  id.String(),
+		Confs: confs,
+	}, nil
+}
+
+// AccountData returns an account with a page of its incoming or outgoing
+// transactions. Transactions and block times are fetched concurrently until
+// ctx is done or ACCOUNT_FETCH_TIMEOUT elapses; whatever could not be fetched
+// by then is reported in the Missing fields instead of failing the page.
+func (ex *Explorer) AccountData(ctx context.Context, walletaddr, transferType string, page uint64) (html.AddressParams, error) {
+	addr, err := address.FromString(walletaddr)
+	if err != nil {
+		return html.AddressParams{}, fmt.Errorf("%w: invalid address %q: %w", errBadInput, walletaddr, err)
+	}
+	addr.PaymentId = 0
+
+	info, err := ex.info()
+	if err != nil {
+		return html.AddressParams{}, err
+	}
+
+	addrInfo, err := ex.client.GetAddress(daemonrpc.GetAddressRequest{
+		Address: addr.String(),
+	})
+	if err != nil {
+		return html.AddressParams{}, lookupError(err, "address "+walletaddr)
+	}
+
+	if transferType != "incoming" && transferType != "outgoing" {
+		transferType = "incoming"
+	}
+
+	// Transaction hash list
+	txs, err := ex.indexer.TxList(addr, transferType, page)
+	if err != nil {
+		return html.AddressParams{}, lookupError(err, "history of address "+walletaddr)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, ACCOUNT_FETCH_TIMEOUT)
+	defer cancel()
+
+	// entries deep enough not to be reorganised away are cached
+	final := func(height uint64) bool {
+		return height != 0 && height+CACHE_MIN_CONFIRMATIONS <= info.Height
+	}
+
+	// Transaction list
+	txResults := eutil.FetchAll(ctx, txs.Transactions, ACCOUNT_FETCH_WORKERS, func(id util.Hash) (*daemonrpc.GetTransactionResponse, error) {
+		return ex.transaction(id, info.Height)
+	})
+
+	var missing []string
+	txList := make([]html.TransactionItem, 0, len(txs.Transactions))
+	for i, id := range txs.Transactions {
+		txRes, err := txResults[i].Value, txResults[i].Err
+		if err != nil {
+			missing = append(missing, id.String())
+			continue
+		}
+
+		txList = append(txList, html.TransactionItem{
+			Tx:     txRes,
+			Txid:   id.String(),
+			Amount: transferAmount(txRes, addr.Addr, transferType),
+		})
+	}
+
+	// Sort them by height
+	sort.Slice(txList, func(a, b int) bool {
+		return txList[a].Tx.Height > txList[b].Tx.Height
+	})
+
+	// For the timestamp of transactions, we need to fetch blocks
+	var heights []uint64
+	for _, tx := range txList {
+		// transactions in the mempool (height 0) have no block yet
+		if tx.Tx.Height != 0 && !slices.Contains(heights, tx.Tx.Height) {
+			heights = append(heights, tx.Tx.Height)
+		}
+	}
+	timeResults := eutil.FetchAll(ctx, heights, ACCOUNT_FETCH_WORKERS, func(height uint64) (string, error) {
+		if t, ok := ex.blockTimes.Get(height); ok {
+			return t, nil
+		}
+		blkRes, err := ex.indexer.BlockByHeight(height)
+		if err != nil {
+			return "", err
+		}
+		// Convert Unix timestamp to UTC string
+		t := (*html.BlockRes)(blkRes).UTC()
+		if final(height) {
+			ex.blockTimes.Add(height, t)
+		}
+		return t, nil
+	})
+
+	blockTimes := make(map[uint64]string, len(heights))
+	missingTimes := 0
+	for i, height := range heights {
+		if timeResults[i].Err != nil {
+			missingTimes++
+			continue
+		}
+		blockTimes[height] = timeResults[i].Value
+	}
+
+	return html.AddressParams{
+		Info:    addrInfo,
+		Address: walletaddr,
+
+		// Transactions
+		Page:         page,
+		MaxPage:      txs.MaxPage,
+		TransferType: transferType,
+		TxList:       txList,
+		BlockTimes:   blockTimes,
+
+		MissingTxids: missing,
+		Missing:      len(missing) + missingTimes,
+	}, nil
+}
+
+// transaction returns a transaction, from the cache if it is deep enough below
+// tip not to be reorganised away.
+func (ex *Explorer) transaction(id util.Hash, tip uint64) (*daemonrpc.GetTransactionResponse, error) {
+	if tx, ok := ex.txCache.Get(id); ok {
+		return tx, nil
+	}
+	tx, err := ex.indexer.Transaction(id)
+	if err == nil && tx.Height != 0 && tx.Height+CACHE_MIN_CONFIRMATIONS <= tip {
+		ex.txCache.Add(id, tx)
+	}
+	return tx, err
+}
+
+// transferAmount returns the amount an address received in a transaction, or
+// the amount it sent.
+func transferAmount(tx *daemonrpc.GetTransactionResponse, addr address.Address, transferType string) uint64 {
+	if transferType != "incoming" {
+		return tx.TotalAmount
+	}
+	var sum uint64
+	for _, o := range tx.Outputs {
+		if o.Recipient == addr {
+			sum += o.Amount
+		}
+	}
+	return sum
+}
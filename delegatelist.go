@@ -1,8 +1,223 @@
 package main
 
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+	"virel-explorer/html"
+	"virel-explorer/index"
+	eutil "virel-explorer/util"
+
+	"github.com/virel-project/virel-blockchain/v3/config"
+	"github.com/virel-project/virel-blockchain/v3/util"
+)
+
+// DELEGATES_STATE_VERSION is the schema version of delegates.json.
+//
+//	1: bare array of KnownDelegate
+//	2: delegatesState, adds the last processed height
+//	3: staked and missed counters replaced by participation records in the index
+const DELEGATES_STATE_VERSION = 3
+
+// UPTIME_RETENTION is how long participation records are kept, in blocks.
+const UPTIME_RETENTION = 30 * config.BLOCKS_PER_DAY
+
+const (
+	MISSED_HEATMAP_DAYS = 30
+	MAX_MISSED_LIST     = 500 // missed blocks listed on the missed blocks page
+)
+
 type KnownDelegate struct {
-	Id           uint64
-	BlocksStaked float64
-	BlocksMissed float64
-	LastHeight   uint64
+	Id         uint64
+	LastHeight uint64 // last block the delegate was chosen for
+}
+
+// delegatesState is the content of delegates.json.
+type delegatesState struct {
+	Version   int              `json:"version"`
+	Height    uint64           `json:"height"` // last block processed
+	Delegates []*KnownDelegate `json:"delegates"`
+	Backfill  *backfillState   `json:"backfill,omitempty"` // blocks below Height still to count
+}
+
+// backfillState is the range of past blocks still to count, see planBackfill.
+type backfillState struct {
+	Height uint64 `json:"height"` // last block counted
+	Target uint64 `json:"target"` // last block to count
+}
+
+// delegatesMigrations upgrade a state from the version of their key to the
+// next one.
+var delegatesMigrations = map[int]func(st *delegatesState) error{
+	// version 1 did not record a height: start again from the recent blocks
+	1: func(st *delegatesState) error { return nil },
+	// the decayed counters cannot be turned into participation records:
+	// scan the uptime window again
+	2: func(st *delegatesState) error {
+		st.Height = 0
+		return nil
+	},
+}
+
+// loadDelegates reads and migrates delegates.json. A missing file is an empty
+// state; a file that cannot be parsed is an error, so that the stats are not
+// silently reset.
+func loadDelegates(path string) (*delegatesState, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &delegatesState{Version: DELEGATES_STATE_VERSION}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	st, err := parseDelegates(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return st, nil
+}
+
+func parseDelegates(data []byte) (*delegatesState, error) {
+	st := &delegatesState{}
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		st.Version = 1
+		if err := json.Unmarshal(data, &st.Delegates); err != nil {
+			return nil, err
+		}
+	} else {
+		if err := json.Unmarshal(data, st); err != nil {
+			return nil, err
+		}
+	}
+
+	if st.Version < 1 || st.Version > DELEGATES_STATE_VERSION {
+		return nil, fmt.Errorf("unsupported version %d, expected at most %d", st.Version, DELEGATES_STATE_VERSION)
+	}
+	for st.Version < DELEGATES_STATE_VERSION {
+		if err := delegatesMigrations[st.Version](st); err != nil {
+			return nil, fmt.Errorf("migrate from version %d: %w", st.Version, err)
+		}
+		st.Version++
+	}
+
+	return st, nil
+}
+
+// delegateUptimes computes the uptime of every delegate with participation
+// records in the last UPTIME_RETENTION blocks below tip.
+func delegateUptimes(db *index.DB, tip uint64) (map[uint64]*html.DelegateUptime, error) {
+	uptimes := make(map[uint64]*html.DelegateUptime)
+	streaks := make(map[uint64]uint64)
+
+	from := tip - min(tip, UPTIME_RETENTION-1)
+	err := db.ScanParticipation(from, func(p index.Participation) {
+		if p.Height > tip {
+			return
+		}
+		u := uptimes[p.Delegate]
+		if u == nil {
+			u = &html.DelegateUptime{}
+			uptimes[p.Delegate] = u
+		}
+
+		for _, w := range []struct {
+			window *html.UptimeWindow
+			blocks uint64
+		}{
+			{&u.Day, config.BLOCKS_PER_DAY},
+			{&u.Week, 7 * config.BLOCKS_PER_DAY},
+			{&u.Month, 30 * config.BLOCKS_PER_DAY},
+		} {
+			if p.Height+w.blocks <= tip {
+				continue
+			}
+			if p.Missed {
+				w.window.Missed++
+			} else {
+				w.window.Staked++
+			}
+		}
+
+		if p.Missed {
+			streaks[p.Delegate]++
+			u.LongestMissStreak = max(u.LongestMissStreak, streaks[p.Delegate])
+			u.LastMissedHeight = p.Height
+		} else {
+			streaks[p.Delegate] = 0
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, u := range uptimes {
+		u.Day.SetPercent()
+		u.Week.SetPercent()
+		u.Month.SetPercent()
+	}
+	return uptimes, nil
+}
+
+// delegateMissed returns the blocks missed by a delegate in the last
+// UPTIME_RETENTION blocks below tip, newest first, and its participation per
+// UTC day over the last MISSED_HEATMAP_DAYS days, oldest first.
+func delegateMissed(db *index.DB, id, tip uint64, now time.Time) ([]html.MissedBlock, []html.MissedDay, error) {
+	today := now.UTC().Truncate(24 * time.Hour)
+	first := today.AddDate(0, 0, -(MISSED_HEATMAP_DAYS - 1))
+
+	days := make([]html.MissedDay, MISSED_HEATMAP_DAYS)
+	for i := range days {
+		days[i].Date = first.AddDate(0, 0, i).Format(time.DateOnly)
+	}
+
+	var missed []html.MissedBlock
+	from := tip - min(tip, UPTIME_RETENTION-1)
+	err := db.ScanParticipation(from, func(p index.Participation) {
+		if p.Delegate != id || p.Height > tip {
+			return
+		}
+
+		var t time.Time
+		if p.Timestamp != 0 {
+			t = time.UnixMilli(int64(p.Timestamp)).UTC()
+			if day := int(t.Sub(first) / (24 * time.Hour)); !t.Before(first) && day < len(days) {
+				if p.Missed {
+					days[day].Missed++
+				} else {
+					days[day].Staked++
+				}
+			}
+		}
+
+		if p.Missed {
+			mb := html.MissedBlock{
+				Height: p.Height,
+				Time:   t,
+			}
+			if p.Hash != (util.Hash{}) {
+				mb.Hash = hex.EncodeToString(p.Hash[:])
+			}
+			missed = append(missed, mb)
+		}
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	slices.Reverse(missed)
+	return missed, days, nil
+}
+
+func (st *delegatesState) save(path string) error {
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	return eutil.WriteFileAtomic(path, data, 0o660)
 }
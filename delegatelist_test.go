@@ -0,0 +1,81 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseDelegates(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    *delegatesState
+		wantErr bool
+	}{
+		// v1 and v2 files hold the baseline KnownDelegate, with decayed
+		// BlocksStaked and BlocksMissed counters
+		{
+			name: "v1 bare array",
+			data: `[{"Id":1,"BlocksStaked":119.84,"BlocksMissed":3.02,"LastHeight":5000},{"Id":2,"BlocksStaked":80,"BlocksMissed":0,"LastHeight":4990}]`,
+			want: &delegatesState{Version: 3, Delegates: []*KnownDelegate{{Id: 1, LastHeight: 5000}, {Id: 2, LastHeight: 4990}}},
+		},
+		{
+			name: "v1 empty",
+			data: " []\n",
+			want: &delegatesState{Version: 3, Delegates: []*KnownDelegate{}},
+		},
+		{
+			name: "v2 rescans the window",
+			data: `{"version":2,"height":5000,"delegates":[{"Id":1,"BlocksStaked":120.5,"BlocksMissed":3.2,"LastHeight":5000}]}`,
+			want: &delegatesState{Version: 3, Height: 0, Delegates: []*KnownDelegate{{Id: 1, LastHeight: 5000}}},
+		},
+		{
+			name: "v3 unchanged",
+			data: `{"version":3,"height":5000,"delegates":[{"Id":1,"LastHeight":5000}]}`,
+			want: &delegatesState{Version: 3, Height: 5000, Delegates: []*KnownDelegate{{Id: 1, LastHeight: 5000}}},
+		},
+		{name: "future version", data: `{"version":4,"height":5000}`, wantErr: true},
+		{name: "missing version", data: `{"height":5000}`, wantErr: true},
+		{name: "truncated", data: `{"version":3,"height":50`, wantErr: true},
+		{name: "bad v1", data: `[{"Id":"one"}]`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseDelegates([]byte(tt.data))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadDelegatesMissing(t *testing.T) {
+	st, err := loadDelegates(filepath.Join(t.TempDir(), "delegates.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Version != DELEGATES_STATE_VERSION || st.Height != 0 || len(st.Delegates) != 0 {
+		t.Fatalf("expected an empty state, got %+v", st)
+	}
+}
+
+func TestLoadDelegatesCorrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "delegates.json")
+	if err := os.WriteFile(path, []byte("{not json"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadDelegates(path); err == nil {
+		t.Fatal("expected a corrupt file to be an error, not an empty state")
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"virel-explorer/html"
+	eutil "virel-explorer/util"
+
+	"github.com/virel-project/virel-blockchain/v3/address"
+	"github.com/virel-project/virel-blockchain/v3/config"
+	"github.com/virel-project/virel-blockchain/v3/rpc/daemonrpc"
+)
+
+const (
+	DELEGATES_REFRESH_INTERVAL = time.Minute
+	DELEGATES_MIN_REFRESH_AGE  = 10 * time.Second // before new delegates trigger a refresh
+	DELEGATES_FETCH_WORKERS    = 8
+)
+
+// DelegateService keeps the records of every known delegate, refreshed from
+// the daemon in the background, so that delegate pages cost no daemon calls.
+type DelegateService struct {
+	client *DaemonPool
+	tip    *TipService
+	blocks *Blocks
+	notify chan struct{}
+	log    *slog.Logger
+
+	mut       sync.RWMutex
+	delegates []*html.DelegateInfo // sorted by score, never modified once stored
+	uptimes   map[uint64]*html.DelegateUptime
+	fetchedAt time.Time
+}
+
+func NewDelegateService(cl *DaemonPool, tip *TipService, bls *Blocks) *DelegateService {
+	return &DelegateService{
+		client: cl,
+		tip:    tip,
+		blocks: bls,
+		notify: make(chan struct{}, 1),
+		log:    slog.With("component", "delegates"),
+	}
+}
+
+// Updater refreshes the delegate records until ctx is done.
+func (s *DelegateService) Updater(ctx context.Context) {
+	ticker := time.NewTicker(DELEGATES_REFRESH_INTERVAL)
+	defer ticker.Stop()
+	for {
+		if err := s.refresh(); err != nil {
+			s.log.Error("failed to refresh delegates", "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-s.notify:
+		}
+	}
+}
+
+// Get returns the delegates, best first, and when they were fetched, which is
+// zero until the first refresh succeeds. It never waits: when the records are
+// missing or new delegates were seen since the last refresh, it asks the
+// updater for one instead.
+func (s *DelegateService) Get() ([]*html.DelegateInfo, time.Time) {
+	s.mut.RLock()
+	delegates, fetchedAt := s.delegates, s.fetchedAt
+	s.mut.RUnlock()
+
+	stale := time.Since(fetchedAt) > DELEGATES_MIN_REFRESH_AGE && len(delegates) < s.blocks.DelegateCount()
+	if fetchedAt.IsZero() || stale {
+		// pending requests collapse into the next refresh
+		select {
+		case s.notify <- struct{}{}:
+		default:
+		}
+	}
+	if delegates == nil {
+		delegates = []*html.DelegateInfo{}
+	}
+
+	return delegates, fetchedAt
+}
+
+// Uptime returns the uptime of a delegate as of the last refresh.
+func (s *DelegateService) Uptime(id uint64) html.DelegateUptime {
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+
+	if u := s.uptimes[id]; u != nil {
+		return *u
+	}
+	return html.DelegateUptime{}
+}
+
+// delegateName returns the name shown for a delegate: only the official
+// delegate may claim to be virel.org.
+func delegateName(id uint64, name string) string {
+	if id != 1 && strings.Contains(strings.ToLower(name), "virel.org") {
+		return "delegate"
+	}
+	return name
+}
+
+func (s *DelegateService) refresh() error {
+	tip, err := s.tip.Get()
+	if err != nil {
+		return err
+	}
+	known := s.blocks.GetDelegates()
+	uptimes, err := delegateUptimes(s.blocks.db, tip.Info.Height)
+	if err != nil {
+		return err
+	}
+
+	s.mut.RLock()
+	previous := make(map[string]*html.DelegateInfo, len(s.delegates))
+	for _, v := range s.delegates {
+		previous[v.Address] = v
+	}
+	s.mut.RUnlock()
+
+	results := eutil.FetchAll(context.Background(), known, DELEGATES_FETCH_WORKERS, func(v KnownDelegate) (*daemonrpc.GetDelegateResponse, error) {
+		return s.client.GetDelegate(daemonrpc.GetDelegateRequest{
+			DelegateAddress: address.NewDelegateAddress(v.Id).String(),
+		})
+	})
+
+	now := time.Now()
+	delegs := make([]*html.DelegateInfo, 0, len(known))
+	failed := 0
+	for i, v := range known {
+		addr := address.NewDelegateAddress(v.Id).String()
+
+		delegateInfo, err := results[i].Value, results[i].Err
+		if err != nil {
+			// keep the last good record rather than dropping the delegate
+			failed++
+			if prev := previous[addr]; prev != nil {
+				delegs = append(delegs, prev)
+			}
+			continue
+		}
+
+		name := delegateName(v.Id, delegateInfo.Name)
+
+		uptime := uptimes[v.Id]
+		if uptime == nil {
+			uptime = &html.DelegateUptime{}
+		}
+
+		delegs = append(delegs, &html.DelegateInfo{
+			Address:        addr,
+			Description:    name,
+			TotalAmount:    delegateInfo.TotalAmount,
+			Balance:        float64(delegateInfo.TotalAmount) / config.COIN,
+			BalancePercent: float64(delegateInfo.TotalAmount) / float64(tip.Info.Stake) * 100,
+			UptimePercent:  uptime.Month.Percent,
+			Uptime:         *uptime,
+			FetchedAt:      now,
+		})
+	}
+	if failed > 0 {
+		s.log.Warn("failed to fetch some delegates", "failed", failed, "total", len(known))
+	}
+	if failed == len(known) && len(known) > 0 {
+		return results[0].Err
+	}
+
+	slices.SortFunc(delegs, func(a, b *html.DelegateInfo) int {
+		return cmp.Compare(b.UptimePercent+b.BalancePercent/8, a.UptimePercent+a.BalancePercent/8)
+	})
+
+	s.mut.Lock()
+	s.delegates = delegs
+	s.uptimes = uptimes
+	s.fetchedAt = now
+	s.mut.Unlock()
+
+	return nil
+}
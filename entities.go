@@ -0,0 +1,315 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"syscall"
+	"time"
+	"virel-explorer/html"
+	eutil "virel-explorer/util"
+
+	"github.com/virel-project/virel-blockchain/v3/address"
+	"github.com/virel-project/virel-blockchain/v3/config"
+	"github.com/virel-project/virel-blockchain/v3/rpc/daemonrpc"
+	"github.com/virel-project/virel-blockchain/v3/util"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+const (
+	ENTITY_MAX_TRANSFERS    = 50
+	ENTITY_MINED_WINDOW     = config.BLOCKS_PER_DAY // blocks scanned for the blocks mined by a pool
+	ENTITY_MAX_MINED_LIST   = 20
+	ENTITY_MINED_CACHE_SIZE = 64
+)
+
+// EntityData returns the balances of the addresses of an entity, their latest
+// transfers and, for pools, the blocks they mined. Like AccountData, whatever
+// could not be fetched within ACCOUNT_FETCH_TIMEOUT is counted in Missing.
+func (ex *Explorer) EntityData(ctx context.Context, slug string) (*html.EntityParams, error) {
+	e := html.EntityBySlug(slug)
+	if e == nil {
+		return nil, fmt.Errorf("%w: entity %s", errNotFound, slug)
+	}
+
+	info, err := ex.info()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, ACCOUNT_FETCH_TIMEOUT)
+	defer cancel()
+
+	p := &html.EntityParams{
+		Entity:    e,
+		Addresses: make([]html.EntityAddress, len(e.Addresses)),
+		Transfers: []html.EntityTransfer{},
+	}
+
+	balances := eutil.FetchAll(ctx, e.Addresses, ACCOUNT_FETCH_WORKERS, func(addr string) (*daemonrpc.GetAddressResponse, error) {
+		return ex.client.GetAddress(daemonrpc.GetAddressRequest{Address: addr})
+	})
+	for i, addr := range e.Addresses {
+		p.Addresses[i].Address = addr
+		if balances[i].Err != nil {
+			p.Missing++
+			continue
+		}
+		p.Addresses[i].Loaded = true
+		p.Addresses[i].Balance = balances[i].Value.Balance
+		p.Addresses[i].MempoolBalance = balances[i].Value.MempoolBalance
+		p.Total += balances[i].Value.Balance
+		p.Mempool += balances[i].Value.MempoolBalance
+	}
+
+	// the first page of history of every address, in both directions
+	type transferRef struct {
+		addr      address.Integrated
+		direction string
+		txid      util.Hash
+	}
+	type historyRef struct {
+		addr      address.Integrated
+		direction string
+	}
+	var histories []historyRef
+	own := make(map[address.Address]bool, len(e.Addresses))
+	for _, v := range e.Addresses {
+		addr, err := address.FromString(v)
+		if err != nil {
+			p.Missing++
+			continue
+		}
+		addr.PaymentId = 0
+		own[addr.Addr] = true
+		histories = append(histories, historyRef{addr, "incoming"}, historyRef{addr, "outgoing"})
+	}
+	historyResults := eutil.FetchAll(ctx, histories, ACCOUNT_FETCH_WORKERS, func(h historyRef) (*daemonrpc.GetTxListResponse, error) {
+		return ex.indexer.TxList(h.addr, h.direction, 0)
+	})
+	var refs []transferRef
+	for i, h := range histories {
+		if historyResults[i].Err != nil {
+			p.Missing++
+			continue
+		}
+		for _, txid := range historyResults[i].Value.Transactions {
+			refs = append(refs, transferRef{h.addr, h.direction, txid})
+		}
+	}
+
+	txResults := eutil.FetchAll(ctx, refs, ACCOUNT_FETCH_WORKERS, func(ref transferRef) (*daemonrpc.GetTransactionResponse, error) {
+		return ex.transaction(ref.txid, info.Height)
+	})
+	// a transaction between addresses of the entity is listed by each of
+	// them: keep one entry per transaction, from the sender's side if it is
+	// one of them
+	byTxid := make(map[util.Hash]int)
+	for i, ref := range refs {
+		tx, err := txResults[i].Value, txResults[i].Err
+		if err != nil {
+			p.Missing++
+			continue
+		}
+		t := html.EntityTransfer{
+			Txid:      ref.txid.String(),
+			Height:    tx.Height,
+			Direction: ref.direction,
+			Address:   ref.addr.Addr.String(),
+		}
+		if ref.direction == "outgoing" {
+			t.Amount = tx.TotalAmount
+			if kept := ownAmount(tx, own); kept > 0 && allOwn(tx, own) {
+				t.Direction = "internal"
+			} else {
+				t.Amount -= min(kept, t.Amount)
+			}
+		} else {
+			t.Amount = ownAmount(tx, own)
+		}
+
+		if j, ok := byTxid[ref.txid]; ok {
+			if ref.direction == "outgoing" {
+				p.Transfers[j] = t
+			}
+			continue
+		}
+		byTxid[ref.txid] = len(p.Transfers)
+		p.Transfers = append(p.Transfers, t)
+	}
+	// pending transfers first, then the latest
+	slices.SortStableFunc(p.Transfers, func(a, b html.EntityTransfer) int {
+		if (a.Height == 0) != (b.Height == 0) {
+			if a.Height == 0 {
+				return -1
+			}
+			return 1
+		}
+		return cmp.Compare(b.Height, a.Height)
+	})
+	if len(p.Transfers) > ENTITY_MAX_TRANSFERS {
+		p.Transfers = p.Transfers[:ENTITY_MAX_TRANSFERS]
+	}
+
+	if e.Category == "pool" {
+		p.Mined, err = ex.minedBlocks(e, info.Height)
+		if err != nil {
+			slog.Error("failed to count mined blocks", "component", "entities", "entity", e.Slug, "err", err)
+			p.Missing++
+		}
+	}
+
+	return p, nil
+}
+
+// ownAmount returns the amount a transaction sends to the given addresses.
+func ownAmount(tx *daemonrpc.GetTransactionResponse, own map[address.Address]bool) uint64 {
+	var sum uint64
+	for _, o := range tx.Outputs {
+		if own[o.Recipient] {
+			sum += o.Amount
+		}
+	}
+	return sum
+}
+
+// allOwn reports whether every output of a transaction goes to the given
+// addresses.
+func allOwn(tx *daemonrpc.GetTransactionResponse, own map[address.Address]bool) bool {
+	for _, o := range tx.Outputs {
+		if !own[o.Recipient] {
+			return false
+		}
+	}
+	return true
+}
+
+// minedCache is what minedBlocks knows of the blocks mined by an entity. It
+// is never modified once stored.
+type minedCache struct {
+	entity  *html.Entity // replaced when the entities are reloaded
+	scanned uint64       // last block scanned
+	hash    string       // hash of the last block scanned, to detect reorgs
+	mined   []html.MinedBlock
+}
+
+// minedBlocks counts the indexed blocks mined by the addresses of an entity in
+// the last ENTITY_MINED_WINDOW blocks below tip. Only the blocks indexed since
+// the previous call are scanned.
+func (ex *Explorer) minedBlocks(e *html.Entity, tip uint64) (*html.EntityMined, error) {
+	from := tip - min(tip, ENTITY_MINED_WINDOW-1)
+
+	c, err := ex.scanMined(e, from, tip, true)
+	if err != nil {
+		return nil, err
+	}
+	ex.mined.Add(e.Slug, c)
+
+	m := &html.EntityMined{Mined: uint64(len(c.mined))}
+	if c.hash != "" && c.scanned >= from {
+		m.Blocks = c.scanned - from + 1
+		m.Percent = float64(m.Mined) / float64(m.Blocks) * 100
+	}
+	m.Recent = slices.Clone(c.mined[len(c.mined)-min(len(c.mined), ENTITY_MAX_MINED_LIST):])
+	slices.Reverse(m.Recent)
+	return m, nil
+}
+
+// scanMined returns the blocks mined by e between from and tip, starting from
+// the cached ones if reuse is set and they are still on the chain.
+func (ex *Explorer) scanMined(e *html.Entity, from, tip uint64, reuse bool) (*minedCache, error) {
+	c := &minedCache{entity: e}
+	start := from
+	old, ok := ex.mined.Get(e.Slug)
+	if reuse && ok && old.entity == e && old.scanned >= from && old.scanned <= tip {
+		start = old.scanned // scanned again to check its hash
+		c.scanned, c.hash = old.scanned, old.hash
+		for _, v := range old.mined {
+			if v.Height >= from {
+				c.mined = append(c.mined, v)
+			}
+		}
+	}
+
+	reorg := false
+	err := ex.indexer.ScanBlocks(start, func(bl *daemonrpc.GetBlockResponse) {
+		if reorg || bl.Block.Height > tip {
+			return
+		}
+		if c.hash != "" && bl.Block.Height == c.scanned {
+			reorg = bl.Hash != c.hash
+			return
+		}
+		c.scanned, c.hash = bl.Block.Height, bl.Hash
+		if slices.Contains(e.Addresses, bl.Miner) {
+			c.mined = append(c.mined, html.MinedBlock{
+				Height: bl.Block.Height,
+				Hash:   bl.Hash,
+				Time:   time.UnixMilli(int64(bl.Block.Timestamp)).UTC(),
+			})
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if reorg {
+		return ex.scanMined(e, from, tip, false)
+	}
+	return c, nil
+}
+
+// reloadEntities loads the entity labels of path. On error the current labels
+// are kept.
+func reloadEntities(path string) error {
+	if err := html.LoadEntities(path); err != nil {
+		slog.Error("failed to load entities", "component", "entities", "path", path, "err", err)
+		return err
+	}
+	slog.Info("entities loaded", "component", "entities", "path", path, "entities", len(html.AllEntities()))
+	return nil
+}
+
+// reloadEntitiesOnHangup reloads the entity labels on every SIGHUP until ctx is
+// done.
+func reloadEntitiesOnHangup(path string) func(ctx context.Context) {
+	return func(ctx context.Context) {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		defer signal.Stop(hup)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				reloadEntities(path)
+			}
+		}
+	}
+}
+
+// registerAdmin adds the /admin endpoints, authenticated by a bearer token.
+// Without a token they are not registered.
+func registerAdmin(e *echo.Echo, settings *Settings) {
+	if settings.AdminToken == "" {
+		return
+	}
+
+	g := e.Group("/admin", middleware.KeyAuth(func(key string, c echo.Context) (bool, error) {
+		return subtle.ConstantTimeCompare([]byte(key), []byte(settings.AdminToken)) == 1, nil
+	}))
+	g.POST("/reload-entities", func(c echo.Context) error {
+		if err := reloadEntities(settings.Entities); err != nil {
+			return c.JSON(http.StatusInternalServerError, apiError{Error: err.Error()})
+		}
+		return c.JSON(http.StatusOK, map[string]int{"entities": len(html.AllEntities())})
+	})
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"virel-explorer/html"
+	"virel-explorer/index"
+	eutil "virel-explorer/util"
+
+	"github.com/virel-project/virel-blockchain/v3/block"
+	"github.com/virel-project/virel-blockchain/v3/rpc/daemonrpc"
+)
+
+func TestMinedBlocks(t *testing.T) {
+	db, err := index.Open(filepath.Join(t.TempDir(), "index.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	ex := &Explorer{
+		indexer: NewIndexer(nil, nil, db),
+		mined:   eutil.NewLRU[string, *minedCache](ENTITY_MINED_CACHE_SIZE),
+	}
+	pool := &html.Entity{Slug: "pool", Addresses: []string{"vpool"}}
+
+	// add indexes blocks up to height to, the pool mining those for which
+	// mine returns true
+	next := uint64(0)
+	add := func(to uint64, fork string, mine func(h uint64) bool) {
+		for ; next <= to; next++ {
+			bl := &daemonrpc.GetBlockResponse{
+				Block: block.Block{Height: next},
+				Hash:  fmt.Sprintf("%s%d", fork, next),
+				Miner: "vother",
+			}
+			if mine(next) {
+				bl.Miner = "vpool"
+			}
+			if err := db.AddBlock(bl, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	check := func(tip, blocks, mined, recent uint64) {
+		t.Helper()
+		m, err := ex.minedBlocks(pool, tip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Blocks != blocks || m.Mined != mined || uint64(len(m.Recent)) != recent {
+			t.Fatalf("tip %d: got %d blocks, %d mined, %d recent, want %d, %d, %d", tip, m.Blocks, m.Mined, len(m.Recent), blocks, mined, recent)
+		}
+		if len(m.Recent) > 1 && m.Recent[0].Height < m.Recent[1].Height {
+			t.Fatalf("tip %d: recent blocks are not latest first", tip)
+		}
+	}
+	even := func(h uint64) bool { return h%2 == 0 }
+
+	add(9, "a", even)
+	check(9, 10, 5, 5)
+	check(9, 10, 5, 5) // from the cache
+
+	add(49, "a", even)
+	check(49, 50, 25, ENTITY_MAX_MINED_LIST)
+
+	// the window slides past the first blocks
+	add(ENTITY_MINED_WINDOW+9, "a", even)
+	check(ENTITY_MINED_WINDOW+9, ENTITY_MINED_WINDOW, ENTITY_MINED_WINDOW/2, ENTITY_MAX_MINED_LIST)
+
+	// a reorg replaces the last blocks with blocks the pool did not mine
+	if err := db.Rollback(ENTITY_MINED_WINDOW); err != nil {
+		t.Fatal(err)
+	}
+	next = ENTITY_MINED_WINDOW
+	add(ENTITY_MINED_WINDOW+9, "b", func(uint64) bool { return false })
+	check(ENTITY_MINED_WINDOW+9, ENTITY_MINED_WINDOW, ENTITY_MINED_WINDOW/2-5, ENTITY_MAX_MINED_LIST)
+
+	// reloaded entities are counted again
+	other := &html.Entity{Slug: "pool", Addresses: []string{"vother"}}
+	m, err := ex.minedBlocks(other, ENTITY_MINED_WINDOW+9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Mined != ENTITY_MINED_WINDOW/2+5 {
+		t.Fatalf("got %d blocks mined after a reload, want %d", m.Mined, ENTITY_MINED_WINDOW/2+5)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"virel-explorer/html"
+	"virel-explorer/index"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Errors returned by the data functions are wrapped around one of these, so
+// that the pages and the API can answer with the right status code.
+var (
+	errNotFound    = errors.New("not found")
+	errBadInput    = errors.New("bad input")
+	errUnavailable = errors.New("daemon unavailable")
+	errTimeout     = errors.New("daemon timeout")
+)
+
+// daemonError types an error returned by a daemon call: transport failures are
+// errUnavailable or errTimeout, anything else is returned as is.
+func daemonError(err error) error {
+	if errors.Is(err, errUnavailable) || errors.Is(err, errTimeout) {
+		return err
+	}
+	var ne net.Error
+	if errors.As(err, &ne) {
+		if ne.Timeout() {
+			return fmt.Errorf("%w: %w", errTimeout, err)
+		}
+		return fmt.Errorf("%w: %w", errUnavailable, err)
+	}
+	return err
+}
+
+// lookupError types the error of a daemon lookup of what, e.g. "block 12":
+// transport failures stay errUnavailable or errTimeout, and the daemon's
+// answers that the item does not exist or is invalid become errNotFound or
+// errBadInput. Their message is not passed on to the user. Anything else, such
+// as a response that cannot be decoded, is an internal error.
+func lookupError(err error, what string) error {
+	err = daemonError(err)
+	if errors.Is(err, errUnavailable) || errors.Is(err, errTimeout) {
+		return fmt.Errorf("%s: %w", what, err)
+	}
+	if errors.Is(err, index.ErrNotFound) {
+		return fmt.Errorf("%w: %s", errNotFound, what)
+	}
+	switch msg := strings.ToLower(err.Error()); {
+	case strings.Contains(msg, "not found"):
+		return fmt.Errorf("%w: %s", errNotFound, what)
+	case strings.Contains(msg, "invalid"):
+		return fmt.Errorf("%w: invalid %s", errBadInput, what)
+	}
+	return fmt.Errorf("%s: %w", what, err)
+}
+
+// httpStatus returns the status code of an error, and the message shown to the
+// user. Internal errors are not detailed.
+func httpStatus(err error) (int, string) {
+	var he *echo.HTTPError
+	switch {
+	case errors.As(err, &he):
+		return he.Code, http.StatusText(he.Code)
+	// a lookup that failed because of the daemon is not a missing item
+	case errors.Is(err, errTimeout), errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout, "The daemon took too long to answer. Please try again."
+	case errors.Is(err, errUnavailable):
+		return http.StatusBadGateway, "The daemon is unavailable. Please try again later."
+	case errors.Is(err, errBadInput):
+		return http.StatusBadRequest, err.Error()
+	case errors.Is(err, errNotFound):
+		return http.StatusNotFound, err.Error()
+	}
+	return http.StatusInternalServerError, "Something went wrong."
+}
+
+func customHTTPErrorHandler(err error, c echo.Context) {
+	if c.Response().Committed {
+		return
+	}
+
+	code, msg := httpStatus(err)
+	if code >= http.StatusInternalServerError {
+		requestLog(c).Error("request failed", "uri", c.Request().RequestURI, "code", code, "err", err)
+	}
+
+	if strings.HasPrefix(c.Request().URL.Path, "/api/") || html.WantsJSON(c) {
+		err = c.JSON(code, apiError{Error: msg})
+	} else {
+		err = html.Error(c, html.ErrorParams{
+			Code:    code,
+			Status:  http.StatusText(code),
+			Message: msg,
+		})
+	}
+	if err != nil {
+		requestLog(c).Error("failed to write error", "err", err)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"virel-explorer/index"
+)
+
+func TestLookupError(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		code   int
+		hidden string // part of the daemon's message that must not be shown
+	}{
+		{"daemon not found", errors.New("block not found in chain db"), http.StatusNotFound, "chain db"},
+		{"index not found", index.ErrNotFound, http.StatusNotFound, ""},
+		{"daemon invalid", errors.New("Invalid address checksum"), http.StatusBadRequest, "checksum"},
+		{"refused", &net.OpError{Op: "dial", Err: os.ErrPermission}, http.StatusBadGateway, "dial"},
+		{"timeout", &net.OpError{Op: "read", Err: os.ErrDeadlineExceeded}, http.StatusGatewayTimeout, "read"},
+		{"pool timeout", errTimeout, http.StatusGatewayTimeout, ""},
+		{"decode", errors.New("unexpected end of JSON input"), http.StatusInternalServerError, "JSON"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := lookupError(tt.err, "block 12")
+			code, msg := httpStatus(err)
+			if code != tt.code {
+				t.Fatalf("got status %d for %v, want %d", code, err, tt.code)
+			}
+			if tt.hidden != "" && strings.Contains(msg, tt.hidden) {
+				t.Fatalf("message %q shows the daemon's error", msg)
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	READY_MAX_INDEX_LAG  = 10               // blocks the index may be behind the daemon tip
+	READY_MAX_MARKET_AGE = 10 * time.Minute // age after which the market data is stale
+)
+
+type readiness struct {
+	Ready  bool              `json:"ready"`
+	Checks map[string]string `json:"checks"`
+}
+
+// registerHealth adds the liveness and readiness probes. /readyz fails once
+// ctx is done, so that load balancers stop routing to a server shutting down.
+func registerHealth(ctx context.Context, e *echo.Echo, ex *Explorer) {
+	e.GET("/healthz", func(c echo.Context) error {
+		return c.String(http.StatusOK, "ok")
+	})
+
+	e.GET("/readyz", func(c echo.Context) error {
+		r := ex.readiness(ctx)
+
+		code := http.StatusOK
+		if !r.Ready {
+			code = http.StatusServiceUnavailable
+		}
+		return c.JSON(code, r)
+	})
+}
+
+func (ex *Explorer) readiness(ctx context.Context) readiness {
+	r := readiness{
+		Ready:  true,
+		Checks: make(map[string]string),
+	}
+	check := func(name, problem string) {
+		if problem == "" {
+			r.Checks[name] = "ok"
+			return
+		}
+		r.Checks[name] = problem
+		r.Ready = false
+	}
+
+	if ctx.Err() != nil {
+		check("server", "shutting down")
+	}
+
+	daemon := "no daemon reachable"
+	for _, st := range ex.client.Status() {
+		if st.Healthy {
+			daemon = ""
+			break
+		}
+	}
+	check("daemon", daemon)
+
+	indexed, daemonHeight := ex.indexer.Heights()
+	switch {
+	case daemonHeight == 0:
+		check("index", "daemon height unknown")
+	case indexed+READY_MAX_INDEX_LAG < daemonHeight:
+		check("index", fmt.Sprintf("%d blocks behind the daemon", daemonHeight-indexed))
+	default:
+		check("index", "")
+	}
+
+	updated := ex.updater.MarketUpdated()
+	switch {
+	case updated.IsZero():
+		check("market", "no market data")
+	case time.Since(updated) > READY_MAX_MARKET_AGE:
+		check("market", fmt.Sprintf("market data is %s old", time.Since(updated).Round(time.Second)))
+	default:
+		check("market", "")
+	}
+
+	return r
+}
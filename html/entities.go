@@ -1,10 +1,234 @@
 package html
 
-var Entities = map[string]string{
-	"v1lmmaprrfp0z2ikclna9fvknf3n6lya65ce3fy": "Exbitron.com",
-	"v9mjh9ggoy0acio6y2ce43g0qt5s6x5dtmbv3k":  "ExPool.net",
-	"vfkpe1x0megmsaek3mhmjqfpn6buyjoa5c5hrt":  "Rplant.xyz",
-	"v139diixrpv0ftmip4mgpuy92u51iq4pnmgjsfn": "Virel Treasury",
-	"v1csprnolatlj3t4dlgwzpgzzjlqmperl1tmfrs": "SafeTrade.com",
-	"vjbyt6ia7gg1udmqnr3h6su4gayzxpfdjghp8v":  "LuckyPool.io",
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/virel-project/virel-blockchain/v3/address"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ENTITY_CATEGORIES are the accepted entity categories.
+var ENTITY_CATEGORIES = []string{"exchange", "pool", "treasury", "bridge", "team"}
+
+// Entity is a known organisation and the addresses it controls.
+type Entity struct {
+	Slug      string   `yaml:"slug" json:"slug"` // URL name, derived from Name if empty
+	Name      string   `yaml:"name" json:"name"`
+	Category  string   `yaml:"category" json:"category"` // one of ENTITY_CATEGORIES
+	Website   string   `yaml:"website" json:"website,omitempty"`
+	Addresses []string `yaml:"addresses" json:"addresses"`
+}
+
+// BadgeClass returns the Bulma classes of the category badge.
+func (e *Entity) BadgeClass() string {
+	switch e.Category {
+	case "exchange":
+		return "tag is-info is-light"
+	case "pool":
+		return "tag is-warning is-light"
+	case "treasury":
+		return "tag is-success is-light"
+	case "bridge":
+		return "tag is-link is-light"
+	case "team":
+		return "tag is-primary is-light"
+	}
+	return "tag is-light"
+}
+
+// entitiesFile is the content of an entity file.
+type entitiesFile struct {
+	Entities []*Entity `yaml:"entities"`
+}
+
+// builtinEntities are used when no entity file is configured.
+var builtinEntities = []*Entity{
+	{Name: "Exbitron.com", Category: "exchange", Addresses: []string{"v1lmmaprrfp0z2ikclna9fvknf3n6lya65ce3fy"}},
+	{Name: "ExPool.net", Category: "pool", Addresses: []string{"v9mjh9ggoy0acio6y2ce43g0qt5s6x5dtmbv3k"}},
+	{Name: "Rplant.xyz", Category: "pool", Addresses: []string{"vfkpe1x0megmsaek3mhmjqfpn6buyjoa5c5hrt"}},
+	{Name: "Virel Treasury", Category: "treasury", Addresses: []string{"v139diixrpv0ftmip4mgpuy92u51iq4pnmgjsfn"}},
+	{Name: "SafeTrade.com", Category: "exchange", Addresses: []string{"v1csprnolatlj3t4dlgwzpgzzjlqmperl1tmfrs"}},
+	{Name: "LuckyPool.io", Category: "pool", Addresses: []string{"vjbyt6ia7gg1udmqnr3h6su4gayzxpfdjghp8v"}},
+}
+
+var (
+	entitiesMut  sync.RWMutex
+	entities     []*Entity // sorted by name, never modified once stored
+	entityByAddr map[string]*Entity
+)
+
+func init() {
+	if err := SetEntities(builtinEntities); err != nil {
+		panic(err)
+	}
+}
+
+// LookupEntity returns the entity controlling an address, or nil.
+func LookupEntity(addr string) *Entity {
+	entitiesMut.RLock()
+	defer entitiesMut.RUnlock()
+	return entityByAddr[addr]
+}
+
+// EntityBySlug returns the entity with the given slug, or nil.
+func EntityBySlug(slug string) *Entity {
+	entitiesMut.RLock()
+	defer entitiesMut.RUnlock()
+	for _, e := range entities {
+		if e.Slug == slug {
+			return e
+		}
+	}
+	return nil
+}
+
+// AllEntities returns the known entities, sorted by name.
+func AllEntities() []*Entity {
+	entitiesMut.RLock()
+	defer entitiesMut.RUnlock()
+	return entities
+}
+
+// LoadEntities reads the entities of a YAML file, or of every .yaml and .yml
+// file of a directory, and replaces the current registry only if all of them
+// are valid. An empty path restores the built-in entities.
+func LoadEntities(path string) error {
+	if path == "" {
+		return SetEntities(builtinEntities)
+	}
+
+	st, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	files := []string{path}
+	if st.IsDir() {
+		files = nil
+		err := filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if ext := filepath.Ext(p); !d.IsDir() && (ext == ".yaml" || ext == ".yml") {
+				files = append(files, p)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	var list []*Entity
+	for _, name := range files {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		var content entitiesFile
+		dec := yaml.NewDecoder(f)
+		dec.KnownFields(true)
+		err = dec.Decode(&content)
+		f.Close()
+		if err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		list = append(list, content.Entities...)
+	}
+
+	return SetEntities(list)
+}
+
+// SetEntities validates entities and makes them the current registry. On error,
+// which names the first bad entry, the current registry is kept.
+func SetEntities(list []*Entity) error {
+	byAddr := make(map[string]*Entity)
+	slugs := make(map[string]bool)
+	stored := make([]*Entity, 0, len(list))
+	for i, v := range list {
+		e := *v
+		e.Addresses = slices.Clone(v.Addresses)
+		if e.Name == "" {
+			return fmt.Errorf("entity #%d: no name", i+1)
+		}
+		if e.Slug == "" {
+			e.Slug = slugify(e.Name)
+			if e.Slug == "" {
+				return fmt.Errorf("entity %s: no slug can be derived from the name, set one", e.Name)
+			}
+		} else if e.Slug != slugify(e.Slug) {
+			return fmt.Errorf("entity %s: invalid slug %q, expected lowercase letters, digits and dashes", e.Name, e.Slug)
+		}
+		if slugs[e.Slug] {
+			return fmt.Errorf("entity %s: duplicate slug %q", e.Name, e.Slug)
+		}
+		slugs[e.Slug] = true
+		if !slices.Contains(ENTITY_CATEGORIES, e.Category) {
+			return fmt.Errorf("entity %s: invalid category %q, expected one of %s", e.Name, e.Category, strings.Join(ENTITY_CATEGORIES, ", "))
+		}
+		if e.Website != "" {
+			if u, err := url.Parse(e.Website); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("entity %s: invalid website %q", e.Name, e.Website)
+			}
+		}
+		if len(e.Addresses) == 0 {
+			return fmt.Errorf("entity %s: no address", e.Name)
+		}
+		for _, addr := range e.Addresses {
+			if _, err := address.FromString(addr); err != nil {
+				return fmt.Errorf("entity %s: invalid address %q: %w", e.Name, addr, err)
+			}
+			if other := byAddr[addr]; other != nil {
+				return fmt.Errorf("entity %s: address %s already belongs to %s", e.Name, addr, other.Name)
+			}
+			byAddr[addr] = &e
+		}
+		stored = append(stored, &e)
+	}
+	slices.SortFunc(stored, func(a, b *Entity) int {
+		return strings.Compare(strings.ToLower(a.Name), strings.ToLower(b.Name))
+	})
+
+	entitiesMut.Lock()
+	entities = stored
+	entityByAddr = byAddr
+	entitiesMut.Unlock()
+	return nil
+}
+
+// slugify turns a name into a URL name, e.g. "Exbitron.com" -> "exbitron-com".
+func slugify(name string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(name) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+			dash = false
+		} else if !dash && b.Len() > 0 {
+			b.WriteByte('-')
+			dash = true
+		}
+	}
+	return strings.TrimSuffix(b.String(), "-")
+}
+
+// entityLabel renders the name and category badge of the entity of addr, or
+// addr itself.
+func entityLabel(addr string) template.HTML {
+	e := LookupEntity(addr)
+	if e == nil {
+		return template.HTML(template.HTMLEscapeString(addr))
+	}
+	return template.HTML(template.HTMLEscapeString(e.Name) +
+		` <span class="` + e.BadgeClass() + `">` + template.HTMLEscapeString(e.Category) + `</span>`)
 }
@@ -0,0 +1,66 @@
+package html
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSetEntities(t *testing.T) {
+	// real addresses, taken from the built-in entities
+	addrA := builtinEntities[0].Addresses[0]
+	addrB := builtinEntities[1].Addresses[0]
+	addrC := builtinEntities[2].Addresses[0]
+
+	tests := []struct {
+		name    string
+		list    []*Entity
+		wantErr string // part of the error, empty if valid
+	}{
+		{"valid", []*Entity{
+			{Name: "Some Pool", Category: "pool", Addresses: []string{addrA}},
+			{Name: "Other", Slug: "other-exchange", Category: "exchange", Website: "https://other.example", Addresses: []string{addrB, addrC}},
+		}, ""},
+		{"no name", []*Entity{{Category: "pool", Addresses: []string{addrA}}}, "entity #1: no name"},
+		{"empty slug", []*Entity{{Name: "!!!", Category: "pool", Addresses: []string{addrA}}}, "entity !!!: no slug"},
+		{"invalid slug", []*Entity{{Name: "Pool", Slug: "Pool/1", Category: "pool", Addresses: []string{addrA}}}, `entity Pool: invalid slug "Pool/1"`},
+		{"duplicate slug", []*Entity{
+			{Name: "Pool", Category: "pool", Addresses: []string{addrA}},
+			{Name: "pool", Category: "pool", Addresses: []string{addrB}},
+		}, `entity pool: duplicate slug "pool"`},
+		{"bad category", []*Entity{{Name: "Pool", Category: "casino", Addresses: []string{addrA}}}, `entity Pool: invalid category "casino"`},
+		{"bad website", []*Entity{{Name: "Pool", Category: "pool", Website: "ftp://pool", Addresses: []string{addrA}}}, "entity Pool: invalid website"},
+		{"no address", []*Entity{{Name: "Pool", Category: "pool"}}, "entity Pool: no address"},
+		{"invalid address", []*Entity{{Name: "Pool", Category: "pool", Addresses: []string{addrA, "not-an-address"}}}, `entity Pool: invalid address "not-an-address"`},
+		{"duplicate address", []*Entity{
+			{Name: "Pool", Category: "pool", Addresses: []string{addrA}},
+			{Name: "Exchange", Category: "exchange", Addresses: []string{addrB, addrA}},
+		}, "entity Exchange: address " + addrA + " already belongs to Pool"},
+	}
+	t.Cleanup(func() { SetEntities(builtinEntities) })
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := SetEntities(builtinEntities); err != nil {
+				t.Fatal(err)
+			}
+			before := AllEntities()
+
+			err := SetEntities(tt.list)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(AllEntities()) != len(tt.list) {
+					t.Fatalf("got %d entities, want %d", len(AllEntities()), len(tt.list))
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("got error %v, want %q", err, tt.wantErr)
+			}
+			if after := AllEntities(); len(after) != len(before) || after[0] != before[0] {
+				t.Fatal("the previous registry was not kept")
+			}
+		})
+	}
+}
@@ -2,11 +2,17 @@ package html
 
 import (
 	"bytes"
+	"embed"
 	"fmt"
 	"html/template"
+	"io/fs"
 	"math"
+	"net/http"
+	"os"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 	"virel-explorer/util"
 
@@ -18,13 +24,93 @@ import (
 	"github.com/labstack/echo/v4"
 )
 
-func parse(file string) *template.Template {
-	// const path = "templates/"
-	const path = "./html/templates/"
+//go:embed templates/*.html
+var embeddedTemplates embed.FS
 
-	//return template.Must(template.New("layout.html").Funcs(funcs).ParseFS(files, path+"layout.html", path+file))
-	return template.Must(
-		template.New("layout.html").Funcs(funcs).ParseFiles(path+"layout.html", path+file, path+"header.html"))
+var templateFS fs.FS = mustSub(embeddedTemplates, "templates")
+
+// SetTemplateOverride makes the templates found in dir take precedence over the
+// embedded ones. Templates missing from dir are still served from the binary.
+func SetTemplateOverride(dir string) {
+	if dir == "" {
+		return
+	}
+	templateFS = util.OverlayFS{
+		Upper: os.DirFS(dir),
+		Lower: mustSub(embeddedTemplates, "templates"),
+	}
+}
+
+func mustSub(fsys fs.FS, dir string) fs.FS {
+	sub, err := fs.Sub(fsys, dir)
+	if err != nil {
+		panic(err)
+	}
+	return sub
+}
+
+// partials are the templates included by every page rather than rendered on
+// their own.
+var partials = []string{"layout.html", "header.html"}
+
+var (
+	pagesMut sync.RWMutex
+	pages    map[string]*template.Template
+)
+
+// LoadTemplates parses every page template and replaces the current set only
+// if all of them parse successfully.
+func LoadTemplates() error {
+	names, err := fs.Glob(mustSub(embeddedTemplates, "templates"), "*.html")
+	if err != nil {
+		return err
+	}
+
+	parsed := make(map[string]*template.Template, len(names))
+	for _, name := range names {
+		if slices.Contains(partials, name) {
+			continue
+		}
+		t, err := template.New("layout.html").Funcs(funcs).ParseFS(templateFS, "layout.html", name, "header.html")
+		if err != nil {
+			return fmt.Errorf("template %s: %w", name, err)
+		}
+		parsed[name] = t
+	}
+
+	pagesMut.Lock()
+	pages = parsed
+	pagesMut.Unlock()
+
+	return nil
+}
+
+// render executes a page template, or writes p as JSON if the client asked for
+// it (see WantsJSON).
+func render(c echo.Context, name string, p any) error {
+	c.Response().Header().Add(echo.HeaderVary, echo.HeaderAccept)
+	status := c.Response().Status // set by Error
+	if status == 0 {
+		status = http.StatusOK
+	}
+	if WantsJSON(c) {
+		return c.JSON(status, p)
+	}
+
+	pagesMut.RLock()
+	t := pages[name]
+	pagesMut.RUnlock()
+	if t == nil {
+		return fmt.Errorf("template %s not loaded", name)
+	}
+
+	b := bytes.NewBuffer([]byte{})
+	err := t.Execute(b, p)
+	if err != nil {
+		return fmt.Errorf("render %s: %w", name, err)
+	}
+
+	return c.HTMLBlob(status, b.Bytes())
 }
 
 var funcs = template.FuncMap{
@@ -60,78 +146,63 @@ var funcs = template.FuncMap{
 	"sub": func(a, b uint64) uint64 {
 		return a - b
 	},
-	"entity": func(s string) string {
-		if len(Entities[s]) > 0 {
-			return Entities[s]
-		}
-		return s
-	},
+	"entity":        entityLabel,
+	"lookup_entity": LookupEntity,
 }
 
 type IndexParams struct {
-	Blocks []*daemonrpc.GetBlockResponse
-	Info   *InfoRes
+	Blocks []*daemonrpc.GetBlockResponse `json:"blocks"`
+	Info   *InfoRes                      `json:"info"`
 }
 type InfoRes daemonrpc.GetInfoResponse
 
 func Index(c echo.Context, p IndexParams) error {
-	b := bytes.NewBuffer([]byte{})
-	err := parse("index.html").Execute(b, p)
-	if err != nil {
-		fmt.Println(err)
-		return err
-	}
-
-	return c.HTMLBlob(200, b.Bytes())
+	return render(c, "index.html", p)
 }
 
 type BlockParams struct {
-	Block *BlockRes
-	Info  *daemonrpc.GetInfoResponse
+	Block *BlockRes                  `json:"block"`
+	Info  *daemonrpc.GetInfoResponse `json:"info"`
 }
 type BlockRes daemonrpc.GetBlockResponse
 
 func Block(c echo.Context, p BlockParams) error {
-	b := bytes.NewBuffer([]byte{})
-	err := parse("block.html").Execute(b, p)
-	if err != nil {
-		fmt.Println(err)
-		return err
-	}
-
-	return c.HTMLBlob(200, b.Bytes())
+	return render(c, "block.html", p)
 }
 
 type TransactionParams struct {
-	Tx    *daemonrpc.GetTransactionResponse
-	Txid  string
-	Confs uint64
+	Tx    *daemonrpc.GetTransactionResponse `json:"tx"`
+	Txid  string                            `json:"txid"`
+	Confs uint64                            `json:"confirmations"`
 }
 
-func Transaction(c echo.Context, p TransactionParams) error {
-	b := bytes.NewBuffer([]byte{})
-	err := parse("transaction.html").Execute(b, p)
-	if err != nil {
-		fmt.Println(err)
-		return err
-	}
+// Pending reports whether the transaction is still in the mempool.
+func (p TransactionParams) Pending() bool {
+	return p.Tx.Height == 0
+}
 
-	return c.HTMLBlob(200, b.Bytes())
+func Transaction(c echo.Context, p TransactionParams) error {
+	return render(c, "transaction.html", p)
 }
 
 /* * Rich List * */
 type RichListItem struct {
-	Rank    int
-	Address string
-	Balance float64
-	Percent float64
+	Rank    int     `json:"rank"`
+	Address string  `json:"address"`
+	Total   uint64  `json:"total"` // atomic units
+	Balance float64 `json:"balance"`
+	Percent float64 `json:"percent"`
+
+	// Set when the rich list is grouped by entity
+	Entity    *Entity `json:"entity,omitempty"`
+	Addresses int     `json:"addresses,omitempty"` // addresses of the rich list merged in this row
 }
 
 type MarketInfo struct {
-	Price     float64
-	Marketcap float64
-	Supply    float64
-	Change    string
+	Price     float64 `json:"price"`
+	Marketcap float64 `json:"marketcap"`
+	Supply    float64 `json:"supply"`
+	Change    string  `json:"change"`
 }
 
 func (m *MarketInfo) IsPositiveChange() bool {
@@ -154,72 +225,83 @@ func (m *MarketInfo) FormatMarketcap() string {
 }
 
 type StatsParams struct {
-	RichList []RichListItem
-	Info     *InfoRes
-	Market   *MarketInfo
+	RichList []RichListItem `json:"rich_list"`
+	Grouped  bool           `json:"grouped"` // addresses of a same entity are merged
+	Info     *InfoRes       `json:"info"`
+	Market   *MarketInfo    `json:"market"`
 }
 
 func Stats(c echo.Context, p StatsParams) error {
-	b := bytes.NewBuffer([]byte{})
-	err := parse("stats.html").Execute(b, p)
-	if err != nil {
-		fmt.Println(err)
-		return err
-	}
-
-	return c.HTMLBlob(200, b.Bytes())
+	return render(c, "stats.html", p)
 }
 
 type StakingParams struct {
-	Info                                      *InfoRes
-	Reward24h, Reward30d, Reward60d, Reward1y float64
+	Info      *InfoRes `json:"info"`
+	Reward24h float64  `json:"reward_24h"`
+	Reward30d float64  `json:"reward_30d"`
+	Reward60d float64  `json:"reward_60d"`
+	Reward1y  float64  `json:"reward_1y"`
 }
 
 func Staking(c echo.Context, p StakingParams) error {
-	b := bytes.NewBuffer([]byte{})
-	err := parse("staking.html").Execute(b, p)
-	if err != nil {
-		fmt.Println(err)
-		return err
-	}
-
-	return c.HTMLBlob(200, b.Bytes())
+	return render(c, "staking.html", p)
 }
 
 type TransactionItem struct {
-	Tx     *daemonrpc.GetTransactionResponse
-	Txid   string
-	Amount uint64
+	Tx     *daemonrpc.GetTransactionResponse `json:"tx"`
+	Txid   string                            `json:"txid"`
+	Amount uint64                            `json:"amount"`
 }
 
 type AddressParams struct {
-	Address string
-	Info    *daemonrpc.GetAddressResponse
+	Address string                        `json:"address"`
+	Info    *daemonrpc.GetAddressResponse `json:"info"`
 
 	// Transactions
-	Page         uint64            // page number for pagination
-	MaxPage      uint64            // total number of available pages
-	TransferType string            // side: incoming / outgoing
-	TxList       []TransactionItem // list of transaction (id + tx)
-	BlockTimes   map[uint64]string // block timestamps (to show transaction timestamps in UTC)
+	Page         uint64            `json:"page"`          // page number for pagination
+	MaxPage      uint64            `json:"max_page"`      // total number of available pages
+	TransferType string            `json:"transfer_type"` // side: incoming / outgoing
+	TxList       []TransactionItem `json:"tx_list"`       // list of transaction (id + tx)
+	BlockTimes   map[uint64]string `json:"block_times"`   // block timestamps (to show transaction timestamps in UTC)
+
+	// Items that could not be fetched in time
+	MissingTxids []string `json:"missing_txids"` // transactions of the page left out of TxList
+	Missing      int      `json:"missing"`       // number of transactions and block times left out
 }
 
-func Address(c echo.Context, p AddressParams) error {
-	b := bytes.NewBuffer([]byte{})
-	err := parse("address.html").Execute(b, p)
-	if err != nil {
-		fmt.Println(err)
-		return err
+// Pending reports whether the account has transactions in the mempool.
+func (p AddressParams) Pending() bool {
+	return p.PendingNonces() > 0 || p.Info.MempoolBalance != p.Info.Balance
+}
+
+// PendingNonces returns the number of transactions of the account in the
+// mempool.
+func (p AddressParams) PendingNonces() uint64 {
+	if p.Info.MempoolNonce <= p.Info.LastNonce {
+		return 0
 	}
+	return p.Info.MempoolNonce - p.Info.LastNonce
+}
 
-	return c.HTMLBlob(200, b.Bytes())
+// PendingDelta returns the change of balance once the mempool transactions are
+// confirmed, with its sign.
+func (p AddressParams) PendingDelta() string {
+	if p.Info.MempoolBalance < p.Info.Balance {
+		return "-" + sutil.FormatCoin(p.Info.Balance-p.Info.MempoolBalance)
+	}
+	return "+" + sutil.FormatCoin(p.Info.MempoolBalance-p.Info.Balance)
+}
+
+func Address(c echo.Context, p AddressParams) error {
+	return render(c, "address.html", p)
 }
 
 type DelegateParams struct {
-	Address string
-	Info    *daemonrpc.GetDelegateResponse
-	Height  uint64
-	Funds   []*Fund
+	Address string                         `json:"address"`
+	Info    *daemonrpc.GetDelegateResponse `json:"info"`
+	Height  uint64                         `json:"height"`
+	Funds   []*Fund                        `json:"funds"`
+	Uptime  DelegateUptime                 `json:"uptime"`
 }
 
 type Fund struct {
@@ -249,14 +331,7 @@ func (d *DelegateParams) Staked() string {
 }
 
 func Delegate(c echo.Context, p *DelegateParams) error {
-	b := bytes.NewBuffer([]byte{})
-	err := parse("delegate.html").Execute(b, p)
-	if err != nil {
-		fmt.Println(err)
-		return err
-	}
-
-	return c.HTMLBlob(200, b.Bytes())
+	return render(c, "delegate.html", p)
 }
 
 func (b *BlockRes) PrintReward() string {
@@ -347,24 +422,219 @@ func (i *InfoRes) Cap() string {
 }
 
 type DelegatesParams struct {
-	Delegates []*DelegateInfo
+	Delegates []*DelegateInfo  `json:"delegates"`
+	FetchedAt time.Time        `json:"fetched_at"` // when the delegate records were fetched from the daemon
+	Loading   bool             `json:"loading"`    // no record fetched yet since startup
+	Backfill  BackfillProgress `json:"backfill"`   // uptime is partial while it is running
 }
 
 type DelegateInfo struct {
-	Address        string
-	Description    string
-	Balance        float64
-	BalancePercent float64
-	UptimePercent  float64
+	Address        string         `json:"address"`
+	Description    string         `json:"description"`
+	TotalAmount    uint64         `json:"total_amount"` // atomic units
+	Balance        float64        `json:"balance"`
+	BalancePercent float64        `json:"balance_percent"`
+	UptimePercent  float64        `json:"uptime_percent"` // over 30 days
+	Uptime         DelegateUptime `json:"uptime"`
+	FetchedAt      time.Time      `json:"fetched_at"`
+}
+
+// DelegateUptime is the participation of a delegate in the blocks it was
+// chosen for.
+type DelegateUptime struct {
+	Day               UptimeWindow `json:"day"`
+	Week              UptimeWindow `json:"week"`
+	Month             UptimeWindow `json:"month"`
+	LongestMissStreak uint64       `json:"longest_miss_streak"` // consecutive missed blocks, over 30 days
+	LastMissedHeight  uint64       `json:"last_missed_height"`  // 0 if none in 30 days
+}
+
+type UptimeWindow struct {
+	Staked  uint64  `json:"staked"`
+	Missed  uint64  `json:"missed"`
+	Percent float64 `json:"percent"`
+}
+
+func (w *UptimeWindow) SetPercent() {
+	if w.Staked+w.Missed == 0 {
+		w.Percent = 0
+		return
+	}
+	w.Percent = float64(w.Staked) / float64(w.Staked+w.Missed) * 100
+}
+
+// Fmt formats the uptime percentage, or a dash if the delegate was not chosen
+// for any block.
+func (w UptimeWindow) Fmt() string {
+	if w.Staked+w.Missed == 0 {
+		return "–"
+	}
+	return strconv.FormatFloat(w.Percent, 'f', 2, 64) + "%"
 }
 
 func Delegates(c echo.Context, p DelegatesParams) error {
-	b := bytes.NewBuffer([]byte{})
-	err := parse("delegates.html").Execute(b, p)
-	if err != nil {
-		fmt.Println(err)
-		return err
+	return render(c, "delegates.html", p)
+}
+
+type MissedParams struct {
+	Address     string        `json:"address"`
+	Id          uint64        `json:"id"`
+	Name        string        `json:"name"`
+	TotalMissed int           `json:"total_missed"` // over 30 days, Missed may be shorter
+	Missed      []MissedBlock `json:"missed"`       // newest first
+	Days        []MissedDay   `json:"days"`         // oldest first
+}
+
+type MissedBlock struct {
+	Height uint64    `json:"height"`
+	Hash   string    `json:"hash"`
+	Time   time.Time `json:"time"`
+}
+
+func (m MissedBlock) UTC() string {
+	if m.Time.IsZero() {
+		return ""
+	}
+	return m.Time.Format("2006-01-02 15:04:05")
+}
+
+// MissedDay is the participation of a delegate over one UTC day.
+type MissedDay struct {
+	Date   string `json:"date"` // YYYY-MM-DD
+	Staked uint64 `json:"staked"`
+	Missed uint64 `json:"missed"`
+}
+
+// Color returns the heatmap color of the day: grey without blocks, then from
+// green to red as the share of missed blocks grows.
+func (d MissedDay) Color() string {
+	total := d.Staked + d.Missed
+	switch {
+	case total == 0:
+		return "#ebedf0"
+	case d.Missed == 0:
+		return "#48c78e"
+	case d.Missed*10 <= total:
+		return "#ffe08a"
+	case d.Missed*2 <= total:
+		return "#ff9f43"
+	default:
+		return "#f14668"
+	}
+}
+
+func Missed(c echo.Context, p *MissedParams) error {
+	return render(c, "missed.html", p)
+}
+
+// BackfillProgress is the progress of the scan of past blocks that rebuilds
+// delegate uptime.
+type BackfillProgress struct {
+	Done  uint64 `json:"done"`  // blocks scanned
+	Total uint64 `json:"total"` // blocks to scan
+}
+
+func (b BackfillProgress) Running() bool {
+	return b.Done < b.Total
+}
+
+func (b BackfillProgress) Percent() float64 {
+	if b.Total == 0 {
+		return 100
 	}
+	return float64(b.Done) / float64(b.Total) * 100
+}
+
+type ReorgInfo struct {
+	Time       time.Time `json:"time"`
+	ForkHeight uint64    `json:"fork_height"` // last height common to both chains
+	Depth      uint64    `json:"depth"`       // number of orphaned blocks
+	OldTip     string    `json:"old_tip"`
+	NewTip     string    `json:"new_tip"`
+}
+
+type SearchResult struct {
+	Kind   string `json:"kind"` // Block, Transaction, Account, Delegate or Entity
+	Title  string `json:"title"`
+	Link   string `json:"link"`
+	Detail string `json:"detail,omitempty"` // hash or address
+}
+
+type SearchParams struct {
+	Query   string         `json:"query"`
+	Results []SearchResult `json:"results"`
+}
+
+func Search(c echo.Context, p SearchParams) error {
+	return render(c, "search.html", p)
+}
+
+type EntityParams struct {
+	Entity    *Entity          `json:"entity"`
+	Total     uint64           `json:"total"`         // balance of the addresses that could be loaded
+	Mempool   uint64           `json:"mempool_total"` // same, including the mempool
+	Addresses []EntityAddress  `json:"addresses"`
+	Transfers []EntityTransfer `json:"transfers"` // latest first, pending ones on top
+	Mined     *EntityMined     `json:"mined,omitempty"`
+	Missing   int              `json:"missing"` // addresses and transactions that could not be loaded
+}
+
+type EntityAddress struct {
+	Address        string `json:"address"`
+	Loaded         bool   `json:"loaded"`
+	Balance        uint64 `json:"balance"`
+	MempoolBalance uint64 `json:"mempool_balance"`
+}
+
+type EntityTransfer struct {
+	Txid      string `json:"txid"`
+	Height    uint64 `json:"height"`    // 0 while in the mempool
+	Direction string `json:"direction"` // incoming, outgoing, or internal between addresses of the entity
+	Address   string `json:"address"`   // address of the entity
+	Amount    uint64 `json:"amount"`    // leaving or reaching the entity, or moved if internal
+}
+
+// EntityMined are the blocks mined by the addresses of a pool.
+type EntityMined struct {
+	Blocks  uint64       `json:"blocks"`  // blocks scanned
+	Mined   uint64       `json:"mined"`   // blocks mined
+	Percent float64      `json:"percent"` // share of the blocks scanned
+	Recent  []MinedBlock `json:"recent"`  // latest first
+}
+
+type MinedBlock struct {
+	Height uint64    `json:"height"`
+	Hash   string    `json:"hash"`
+	Time   time.Time `json:"time"`
+}
+
+func (m MinedBlock) UTC() string {
+	if m.Time.IsZero() {
+		return ""
+	}
+	return m.Time.Format("2006-01-02 15:04:05")
+}
+
+func EntityPage(c echo.Context, p *EntityParams) error {
+	return render(c, "entity.html", p)
+}
+
+type ErrorParams struct {
+	Code    int    `json:"code"`
+	Status  string `json:"status"`
+	Message string `json:"message"`
+}
+
+// Error renders the error page with the status code of the error.
+func Error(c echo.Context, p ErrorParams) error {
+	c.Response().Status = p.Code
+	return render(c, "error.html", p)
+}
+
+type ReorgsParams struct {
+	Reorgs []*ReorgInfo `json:"reorgs"`
+}
 
-	return c.HTMLBlob(200, b.Bytes())
+func Reorgs(c echo.Context, p ReorgsParams) error {
+	return render(c, "reorgs.html", p)
 }
@@ -0,0 +1,40 @@
+package html
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// WantsJSON reports whether the client asked for JSON instead of HTML, either
+// with "?format=json" or with an Accept header preferring application/json.
+func WantsJSON(c echo.Context) bool {
+	switch c.QueryParam("format") {
+	case "json":
+		return true
+	case "html":
+		return false
+	}
+
+	var htmlQ, jsonQ float64 = -1, -1
+	for _, part := range strings.Split(c.Request().Header.Get(echo.HeaderAccept), ",") {
+		mediaType, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		for _, p := range strings.Split(params, ";") {
+			if v, ok := strings.CutPrefix(strings.TrimSpace(p), "q="); ok {
+				if f, err := strconv.ParseFloat(v, 64); err == nil {
+					q = f
+				}
+			}
+		}
+
+		switch strings.TrimSpace(mediaType) {
+		case "text/html":
+			htmlQ = max(htmlQ, q)
+		case echo.MIMEApplicationJSON:
+			jsonQ = max(jsonQ, q)
+		}
+	}
+	return jsonQ > 0 && jsonQ > htmlQ
+}
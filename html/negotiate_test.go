@@ -0,0 +1,44 @@
+package html
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestWantsJSON(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		accept string
+		want   bool
+	}{
+		{"no header", "", "", false},
+		{"browser", "", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", false},
+		{"json", "", "application/json", true},
+		{"anything", "", "*/*", false},
+		{"json preferred", "", "text/html;q=0.5, application/json", true},
+		{"html preferred", "", "application/json;q=0.5, text/html", false},
+		{"equal quality", "", "application/json, text/html", false},
+		{"json refused", "", "application/json;q=0", false},
+		{"json with params", "", "application/json; charset=utf-8; q=0.9, text/html; q=0.8", true},
+		{"bad quality", "", "application/json;q=x", true},
+		{"format json", "format=json", "text/html", true},
+		{"format html", "format=html", "application/json", false},
+		{"unknown format", "format=xml", "application/json", true},
+	}
+	e := echo.New()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/block/1?"+tt.query, nil)
+			if tt.accept != "" {
+				req.Header.Set(echo.HeaderAccept, tt.accept)
+			}
+			c := e.NewContext(req, httptest.NewRecorder())
+			if got := WantsJSON(c); got != tt.want {
+				t.Errorf("WantsJSON(%q, %q) = %v, want %v", tt.query, tt.accept, got, tt.want)
+			}
+		})
+	}
+}
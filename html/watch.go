@@ -0,0 +1,55 @@
+package html
+
+import (
+	"log/slog"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// WatchTemplates re-parses the templates whenever a file in dir changes. A
+// template that fails to parse is reported and the previous set is kept.
+func WatchTemplates(dir string) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := w.Add(dir); err != nil {
+		w.Close()
+		return err
+	}
+
+	go func() {
+		defer w.Close()
+
+		// editors usually emit several events per save, so reloads are
+		// debounced
+		var reload <-chan time.Time
+		for {
+			select {
+			case ev, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				if filepath.Ext(ev.Name) == ".html" {
+					reload = time.After(100 * time.Millisecond)
+				}
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				slog.Error("template watcher failed", "component", "templates", "err", err)
+			case <-reload:
+				reload = nil
+				if err := LoadTemplates(); err != nil {
+					slog.Error("failed to reload templates", "component", "templates", "err", err)
+				} else {
+					slog.Info("templates reloaded", "component", "templates")
+				}
+			}
+		}
+	}()
+
+	return nil
+}
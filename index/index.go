@@ -0,0 +1,413 @@
+// Package index is the explorer's on-disk copy of the chain: blocks,
+// transactions, per-address transaction history and delegate participation,
+// stored in a bbolt database so that pages can be served without querying the
+// daemon.
+package index
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/virel-project/virel-blockchain/v3/rpc/daemonrpc"
+	"github.com/virel-project/virel-blockchain/v3/util"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const PAGE_SIZE = 20 // transactions per page of address history
+
+const (
+	INCOMING = "incoming"
+	OUTGOING = "outgoing"
+)
+
+var ErrNotFound = errors.New("not found")
+
+var (
+	bucketMeta    = []byte("meta")
+	bucketBlocks  = []byte("blocks")  // height -> block
+	bucketHashes  = []byte("hashes")  // block hash -> height
+	bucketTxs     = []byte("txs")     // txid -> transaction
+	bucketAddrTxs = []byte("addrtxs") // address | direction | height | txid -> nil, address | direction -> count
+
+	bucketParticipation = []byte("participation") // height -> delegate id | missed | timestamp | hash
+
+	keyNext = []byte("next") // next height to index
+)
+
+type DB struct {
+	db *bolt.DB
+}
+
+// Tx is a transaction together with its id.
+type Tx struct {
+	Txid util.Hash
+	Tx   *daemonrpc.GetTransactionResponse
+}
+
+func Open(path string) (*DB, error) {
+	db, err := bolt.Open(path, 0o660, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("open index %s: %w", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{bucketMeta, bucketBlocks, bucketHashes, bucketTxs, bucketAddrTxs, bucketParticipation} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &DB{db: db}, nil
+}
+
+func (d *DB) Close() error {
+	return d.db.Close()
+}
+
+func itob(n uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, n)
+}
+
+// Next returns the height of the next block to index, which is also the number
+// of indexed blocks.
+func (d *DB) Next() (next uint64, err error) {
+	err = d.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(bucketMeta).Get(keyNext); v != nil {
+			next = binary.BigEndian.Uint64(v)
+		}
+		return nil
+	})
+	return
+}
+
+// AddBlock stores a block and its transactions. Blocks must be added in
+// height order.
+func (d *DB) AddBlock(bl *daemonrpc.GetBlockResponse, txs []Tx) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(bucketMeta)
+
+		var next uint64
+		if v := meta.Get(keyNext); v != nil {
+			next = binary.BigEndian.Uint64(v)
+		}
+		if bl.Block.Height != next {
+			return fmt.Errorf("cannot index block %d, expected height %d", bl.Block.Height, next)
+		}
+
+		data, err := json.Marshal(bl)
+		if err != nil {
+			return err
+		}
+		if err := tx.Bucket(bucketBlocks).Put(itob(bl.Block.Height), data); err != nil {
+			return err
+		}
+		if err := tx.Bucket(bucketHashes).Put([]byte(bl.Hash), itob(bl.Block.Height)); err != nil {
+			return err
+		}
+
+		for _, t := range txs {
+			data, err := json.Marshal(t.Tx)
+			if err != nil {
+				return err
+			}
+			if err := tx.Bucket(bucketTxs).Put(t.Txid[:], data); err != nil {
+				return err
+			}
+			for _, k := range addrTxKeys(bl.Block.Height, t) {
+				if err := addAddrTx(tx.Bucket(bucketAddrTxs), k, 1); err != nil {
+					return err
+				}
+			}
+		}
+
+		return meta.Put(keyNext, itob(next+1))
+	})
+}
+
+// addAddrTx adds (delta 1) or removes (delta -1) a history entry and keeps the
+// counter of its address and direction, stored under the entry prefix, in sync.
+func addAddrTx(b *bolt.Bucket, k []byte, delta int) error {
+	if delta > 0 {
+		if err := b.Put(k, nil); err != nil {
+			return err
+		}
+	} else if err := b.Delete(k); err != nil {
+		return err
+	}
+
+	prefix := k[:len(k)-8-32]
+	var count uint64
+	if v := b.Get(prefix); v != nil {
+		count = binary.BigEndian.Uint64(v)
+	}
+	count = uint64(int64(count) + int64(delta))
+	if count == 0 {
+		return b.Delete(prefix)
+	}
+	return b.Put(prefix, itob(count))
+}
+
+func addrTxPrefix(addr, direction string) []byte {
+	k := make([]byte, 0, len(addr)+2+8+32)
+	k = append(k, addr...)
+	k = append(k, 0, direction[0])
+	return k
+}
+
+func addrTxKey(addr, direction string, height uint64, txid util.Hash) []byte {
+	k := addrTxPrefix(addr, direction)
+	k = binary.BigEndian.AppendUint64(k, height)
+	return append(k, txid[:]...)
+}
+
+// addrTxKeys returns the history entries of a transaction: an outgoing entry
+// for its signer and an incoming entry for each distinct recipient.
+func addrTxKeys(height uint64, t Tx) [][]byte {
+	var keys [][]byte
+	if t.Tx.Signer != nil {
+		keys = append(keys, addrTxKey(t.Tx.Signer.Addr.String(), OUTGOING, height, t.Txid))
+	}
+	seen := make(map[string]bool)
+	for _, o := range t.Tx.Outputs {
+		recipient := o.Recipient.String()
+		if seen[recipient] {
+			continue
+		}
+		seen[recipient] = true
+		keys = append(keys, addrTxKey(recipient, INCOMING, height, t.Txid))
+	}
+	return keys
+}
+
+// Block returns the indexed block at the given height.
+func (d *DB) Block(height uint64) (*daemonrpc.GetBlockResponse, error) {
+	var bl *daemonrpc.GetBlockResponse
+	err := d.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bucketBlocks).Get(itob(height))
+		if v == nil {
+			return ErrNotFound
+		}
+		bl = &daemonrpc.GetBlockResponse{}
+		return json.Unmarshal(v, bl)
+	})
+	return bl, err
+}
+
+// ScanBlocks calls fn for every indexed block from the given height up, in
+// height order.
+func (d *DB) ScanBlocks(from uint64, fn func(bl *daemonrpc.GetBlockResponse)) error {
+	return d.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucketBlocks).Cursor()
+		for k, v := c.Seek(itob(from)); k != nil; k, v = c.Next() {
+			bl := &daemonrpc.GetBlockResponse{}
+			if err := json.Unmarshal(v, bl); err != nil {
+				return err
+			}
+			fn(bl)
+		}
+		return nil
+	})
+}
+
+// BlockByHash returns the indexed block with the given hex hash.
+func (d *DB) BlockByHash(hash string) (*daemonrpc.GetBlockResponse, error) {
+	var height uint64
+	err := d.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bucketHashes).Get([]byte(hash))
+		if v == nil {
+			return ErrNotFound
+		}
+		height = binary.BigEndian.Uint64(v)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return d.Block(height)
+}
+
+// BlocksByHashPrefix returns up to n indexed blocks whose hex hash starts
+// with prefix, in hash order.
+func (d *DB) BlocksByHashPrefix(prefix string, n int) ([]*daemonrpc.GetBlockResponse, error) {
+	var heights []uint64
+	err := d.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucketHashes).Cursor()
+		for k, v := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)) && len(heights) < n; k, v = c.Next() {
+			heights = append(heights, binary.BigEndian.Uint64(v))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	blocks := make([]*daemonrpc.GetBlockResponse, 0, len(heights))
+	for _, h := range heights {
+		bl, err := d.Block(h)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, bl)
+	}
+	return blocks, nil
+}
+
+// TxidsByPrefix returns up to n indexed transaction ids whose hex form starts
+// with prefix, in id order.
+func (d *DB) TxidsByPrefix(prefix string, n int) ([]util.Hash, error) {
+	raw, err := hex.DecodeString(prefix[:len(prefix)&^1])
+	if err != nil {
+		return nil, err
+	}
+	// an odd prefix ends with the high half of the next byte
+	seek, odd := raw, len(prefix)%2 == 1
+	var nibble byte
+	if odd {
+		v, err := hex.DecodeString(prefix[len(prefix)-1:] + "0")
+		if err != nil {
+			return nil, err
+		}
+		nibble = v[0]
+		seek = append(bytes.Clone(raw), nibble)
+	}
+
+	var txids []util.Hash
+	err = d.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucketTxs).Cursor()
+		for k, _ := c.Seek(seek); k != nil && bytes.HasPrefix(k, raw) && len(txids) < n; k, _ = c.Next() {
+			if odd && (len(k) == len(raw) || k[len(raw)]&0xf0 != nibble) {
+				break
+			}
+			txids = append(txids, util.Hash(k))
+		}
+		return nil
+	})
+	return txids, err
+}
+
+// Transaction returns an indexed transaction.
+func (d *DB) Transaction(txid util.Hash) (*daemonrpc.GetTransactionResponse, error) {
+	var res *daemonrpc.GetTransactionResponse
+	err := d.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bucketTxs).Get(txid[:])
+		if v == nil {
+			return ErrNotFound
+		}
+		res = &daemonrpc.GetTransactionResponse{}
+		return json.Unmarshal(v, res)
+	})
+	return res, err
+}
+
+// AddressTxs returns a page of the transaction history of an address, newest
+// first, and the number of the last page.
+func (d *DB) AddressTxs(addr, direction string, page uint64) (txids []util.Hash, maxPage uint64, err error) {
+	prefix := addrTxPrefix(addr, direction)
+
+	err = d.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketAddrTxs)
+
+		var count uint64
+		if v := b.Get(prefix); v != nil {
+			count = binary.BigEndian.Uint64(v)
+		}
+		if count == 0 {
+			return nil
+		}
+		maxPage = (count - 1) / PAGE_SIZE
+		if page > maxPage {
+			return nil
+		}
+
+		// seek past the last key with the prefix, then walk backwards; the
+		// counter key is the prefix itself, so it is reached last
+		c := b.Cursor()
+		end := append(bytes.Clone(prefix), 0xff)
+		k, _ := c.Seek(end)
+		if k == nil {
+			k, _ = c.Last()
+		} else {
+			k, _ = c.Prev()
+		}
+
+		skip := page * PAGE_SIZE
+		for ; k != nil && len(k) > len(prefix) && bytes.HasPrefix(k, prefix); k, _ = c.Prev() {
+			if skip > 0 {
+				skip--
+				continue
+			}
+			txids = append(txids, util.Hash(k[len(k)-32:]))
+			if len(txids) == PAGE_SIZE {
+				break
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// Rollback removes every block from the given height up, together with their
+// transactions and address history, so that indexing resumes at height.
+func (d *DB) Rollback(height uint64) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(bucketMeta)
+		blocks := tx.Bucket(bucketBlocks)
+		txs := tx.Bucket(bucketTxs)
+
+		var next uint64
+		if v := meta.Get(keyNext); v != nil {
+			next = binary.BigEndian.Uint64(v)
+		}
+
+		for h := height; h < next; h++ {
+			v := blocks.Get(itob(h))
+			if v == nil {
+				continue
+			}
+			bl := &daemonrpc.GetBlockResponse{}
+			if err := json.Unmarshal(v, bl); err != nil {
+				return err
+			}
+
+			for _, txid := range bl.Block.Transactions {
+				v := txs.Get(txid[:])
+				if v == nil {
+					continue
+				}
+				t := Tx{Txid: txid, Tx: &daemonrpc.GetTransactionResponse{}}
+				if err := json.Unmarshal(v, t.Tx); err != nil {
+					return err
+				}
+				for _, k := range addrTxKeys(h, t) {
+					if err := addAddrTx(tx.Bucket(bucketAddrTxs), k, -1); err != nil {
+						return err
+					}
+				}
+				if err := txs.Delete(txid[:]); err != nil {
+					return err
+				}
+			}
+
+			if err := tx.Bucket(bucketHashes).Delete([]byte(bl.Hash)); err != nil {
+				return err
+			}
+			if err := blocks.Delete(itob(h)); err != nil {
+				return err
+			}
+		}
+
+		return meta.Put(keyNext, itob(min(height, next)))
+	})
+}
@@ -0,0 +1,167 @@
+package index
+
+import (
+	"encoding/hex"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/virel-project/virel-blockchain/v3/address"
+	"github.com/virel-project/virel-blockchain/v3/block"
+	"github.com/virel-project/virel-blockchain/v3/rpc/daemonrpc"
+	"github.com/virel-project/virel-blockchain/v3/util"
+)
+
+var (
+	testSender    = address.Address{1}
+	testRecipient = address.Address{2}
+)
+
+// testBlock returns a block of the given height with n transfers from
+// testSender to testRecipient.
+func testBlock(height uint64, n int) (*daemonrpc.GetBlockResponse, []Tx) {
+	bl := &daemonrpc.GetBlockResponse{
+		Block: block.Block{Height: height},
+		Hash:  util.Hash{byte(height), 0xbb}.String(),
+	}
+	var txs []Tx
+	for i := range n {
+		txid := util.Hash{byte(height), byte(i), 0xaa}
+		bl.Block.Transactions = append(bl.Block.Transactions, txid)
+		txs = append(txs, Tx{Txid: txid, Tx: &daemonrpc.GetTransactionResponse{
+			Signer:  &address.Integrated{Addr: testSender},
+			Outputs: []daemonrpc.Output{{Recipient: testRecipient, Amount: 1}},
+			Height:  height,
+		}})
+	}
+	return bl, txs
+}
+
+func TestAddressTxs(t *testing.T) {
+	tests := []struct {
+		name     string
+		blocks   []int  // transactions per block, from height 0
+		rollback uint64 // height to roll back to, or none if past the blocks
+		page     uint64
+		want     int // transactions on the page
+		maxPage  uint64
+	}{
+		{"empty", nil, 0, 0, 0, 0},
+		{"one page", []int{3, 2}, 10, 0, 5, 0},
+		{"first of two pages", []int{15, 10}, 10, 0, PAGE_SIZE, 1},
+		{"last of two pages", []int{15, 10}, 10, 1, 5, 1},
+		{"page out of range", []int{15, 10}, 10, 2, 0, 1},
+		{"rolled back block", []int{15, 10}, 1, 0, 15, 0},
+		{"rolled back all", []int{15, 10}, 0, 0, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, err := Open(filepath.Join(t.TempDir(), "index.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			var all []util.Hash
+			for h, n := range tt.blocks {
+				bl, txs := testBlock(uint64(h), n)
+				if err := db.AddBlock(bl, txs); err != nil {
+					t.Fatal(err)
+				}
+				if uint64(h) < tt.rollback {
+					all = append(all, bl.Block.Transactions...)
+				}
+			}
+			if err := db.Rollback(tt.rollback); err != nil {
+				t.Fatal(err)
+			}
+			slices.Reverse(all)
+
+			for _, dir := range []struct {
+				addr, direction string
+			}{
+				{address.Integrated{Addr: testSender}.String(), OUTGOING},
+				{testRecipient.String(), INCOMING},
+			} {
+				txids, maxPage, err := db.AddressTxs(dir.addr, dir.direction, tt.page)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(txids) != tt.want || maxPage != tt.maxPage {
+					t.Fatalf("%s: got %d transactions, last page %d, want %d, %d", dir.direction, len(txids), maxPage, tt.want, tt.maxPage)
+				}
+				if tt.want > 0 {
+					start := int(tt.page) * PAGE_SIZE
+					if !slices.Equal(txids, all[start:start+tt.want]) {
+						t.Fatalf("%s: got %x, want newest first %x", dir.direction, txids, all[start:start+tt.want])
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestHashPrefix(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "index.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// txids 0000aa.., 0001aa.., 0002aa.. at height 0 and 0100aa.., 0101aa..
+	// at height 1; block hashes 00bb.. and 01bb..
+	for h, n := range []int{3, 2} {
+		bl, txs := testBlock(uint64(h), n)
+		bl.Hash = hex.EncodeToString([]byte{byte(h), 0xbb}) + strings.Repeat("0", 60)
+		if err := db.AddBlock(bl, txs); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		prefix string
+		n      int
+		blocks int
+		txids  []string // hex of the first two bytes
+	}{
+		{"00", 10, 1, []string{"0000", "0001", "0002"}},
+		{"01", 10, 1, []string{"0100", "0101"}},
+		{"0", 10, 2, []string{"0000", "0001", "0002", "0100", "0101"}},
+		{"000", 10, 0, []string{"0000", "0001", "0002"}},
+		{"0101", 10, 0, []string{"0101"}},
+		{"010", 10, 0, []string{"0100", "0101"}},
+		{"00bb", 10, 1, nil},
+		{"0", 2, 2, []string{"0000", "0001"}},
+		{"02", 10, 0, nil},
+		{"f", 10, 0, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.prefix, func(t *testing.T) {
+			blocks, err := db.BlocksByHashPrefix(tt.prefix, tt.n)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(blocks) != tt.blocks {
+				t.Errorf("got %d blocks, want %d", len(blocks), tt.blocks)
+			}
+			for _, bl := range blocks {
+				if !strings.HasPrefix(bl.Hash, tt.prefix) {
+					t.Errorf("block %s does not start with %s", bl.Hash, tt.prefix)
+				}
+			}
+
+			txids, err := db.TxidsByPrefix(tt.prefix, tt.n)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, txid := range txids {
+				got = append(got, hex.EncodeToString(txid[:2]))
+			}
+			if !slices.Equal(got, tt.txids) {
+				t.Errorf("got txids %v, want %v", got, tt.txids)
+			}
+		})
+	}
+}
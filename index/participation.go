@@ -0,0 +1,126 @@
+package index
+
+import (
+	"encoding/binary"
+	"slices"
+
+	"github.com/virel-project/virel-blockchain/v3/util"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Participation records whether the delegate chosen for a block staked it.
+type Participation struct {
+	Height    uint64
+	Delegate  uint64
+	Missed    bool
+	Timestamp uint64 // block timestamp, in milliseconds
+	Hash      util.Hash
+}
+
+func (p Participation) value() []byte {
+	v := binary.AppendUvarint(nil, p.Delegate)
+	if p.Missed {
+		v = append(v, 1)
+	} else {
+		v = append(v, 0)
+	}
+	v = binary.AppendUvarint(v, p.Timestamp)
+	return append(v, p.Hash[:]...)
+}
+
+func parseParticipation(k, v []byte) Participation {
+	p := Participation{Height: binary.BigEndian.Uint64(k)}
+
+	id, n := binary.Uvarint(v)
+	if n <= 0 || n >= len(v) {
+		return p
+	}
+	p.Delegate = id
+	p.Missed = v[n] == 1
+	v = v[n+1:]
+
+	ts, n := binary.Uvarint(v)
+	if n <= 0 || len(v)-n != len(p.Hash) {
+		return p
+	}
+	p.Timestamp = ts
+	copy(p.Hash[:], v[n:])
+	return p
+}
+
+// PutParticipation stores participation records, replacing those already
+// stored at the same heights.
+func (d *DB) PutParticipation(records ...Participation) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketParticipation)
+		for _, p := range records {
+			if err := b.Put(itob(p.Height), p.value()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DeleteParticipation removes the participation records from the given
+// height up.
+func (d *DB) DeleteParticipation(from uint64) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucketParticipation).Cursor()
+		for k, _ := c.Seek(itob(from)); k != nil; k, _ = c.Seek(itob(from)) {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// PruneParticipation removes the participation records below the given height.
+func (d *DB) PruneParticipation(below uint64) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucketParticipation).Cursor()
+		for k, _ := c.First(); k != nil && binary.BigEndian.Uint64(k) < below; k, _ = c.First() {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ScanParticipation calls fn for every participation record from the given
+// height up, in height order.
+func (d *DB) ScanParticipation(from uint64, fn func(p Participation)) error {
+	return d.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucketParticipation).Cursor()
+		for k, v := c.Seek(itob(from)); k != nil; k, v = c.Next() {
+			fn(parseParticipation(k, v))
+		}
+		return nil
+	})
+}
+
+// LastParticipation returns the height of the last record below the given
+// height of each of the given delegates. Delegates without one are left out.
+func (d *DB) LastParticipation(below uint64, ids ...uint64) (map[uint64]uint64, error) {
+	last := make(map[uint64]uint64, len(ids))
+	err := d.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucketParticipation).Cursor()
+		k, v := c.Seek(itob(below))
+		if k == nil {
+			k, v = c.Last()
+		} else {
+			k, v = c.Prev()
+		}
+		for ; k != nil && len(last) < len(ids); k, v = c.Prev() {
+			p := parseParticipation(k, v)
+			if _, ok := last[p.Delegate]; !ok && slices.Contains(ids, p.Delegate) {
+				last[p.Delegate] = p.Height
+			}
+		}
+		return nil
+	})
+	return last, err
+}
@@ -0,0 +1,48 @@
+package index
+
+import (
+	"maps"
+	"path/filepath"
+	"testing"
+)
+
+func TestLastParticipation(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "index.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// delegates 1, 2, 3, 1, 2, 1 at heights 10 to 15
+	var records []Participation
+	for i, id := range []uint64{1, 2, 3, 1, 2, 1} {
+		records = append(records, Participation{Height: 10 + uint64(i), Delegate: id})
+	}
+	if err := db.PutParticipation(records...); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		below uint64
+		ids   []uint64
+		want  map[uint64]uint64
+	}{
+		{"past the records", 100, []uint64{1, 2, 3}, map[uint64]uint64{1: 15, 2: 14, 3: 12}},
+		{"orphaned tip", 15, []uint64{1, 2}, map[uint64]uint64{1: 13, 2: 14}},
+		{"unknown delegate", 15, []uint64{4}, map[uint64]uint64{}},
+		{"below the first record", 11, []uint64{2}, map[uint64]uint64{}},
+		{"first record", 11, []uint64{1}, map[uint64]uint64{1: 10}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := db.LastParticipation(tt.below, tt.ids...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !maps.Equal(got, tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+	"virel-explorer/index"
+
+	"github.com/virel-project/virel-blockchain/v3/address"
+	"github.com/virel-project/virel-blockchain/v3/rpc/daemonrpc"
+	"github.com/virel-project/virel-blockchain/v3/util"
+)
+
+// Indexer copies the chain from the daemon into the local index, and serves
+// blocks and transactions from it, falling back to the daemon for anything
+// not indexed yet.
+type Indexer struct {
+	client *DaemonPool
+	tip    *TipService
+	db     *index.DB
+
+	mut          sync.RWMutex
+	daemonHeight uint64
+
+	log *slog.Logger
+}
+
+func NewIndexer(cl *DaemonPool, tip *TipService, db *index.DB) *Indexer {
+	return &Indexer{
+		client: cl,
+		tip:    tip,
+		db:     db,
+		log:    slog.With("component", "index"),
+	}
+}
+
+// Updater indexes new blocks until ctx is done.
+func (ix *Indexer) Updater(ctx context.Context) {
+	for ctx.Err() == nil {
+		updated, err := ix.update()
+		if err != nil {
+			ix.log.Error("failed to index", "err", err)
+		}
+		if !updated {
+			sleep(ctx, 2*time.Second)
+		}
+	}
+}
+
+// update indexes the next block, if any.
+func (ix *Indexer) update() (bool, error) {
+	next, err := ix.db.Next()
+	if err != nil {
+		return false, err
+	}
+
+	tip, err := ix.tip.Get()
+	if err != nil {
+		return false, err
+	}
+	info := tip.Info
+	ix.mut.Lock()
+	ix.daemonHeight = info.Height
+	ix.mut.Unlock()
+
+	if next > info.Height {
+		return false, nil
+	}
+
+	bl, err := ix.client.GetBlockByHeight(daemonrpc.GetBlockByHeightRequest{
+		Height: next,
+	})
+	if err != nil {
+		return false, err
+	}
+
+	if next > 0 {
+		prev, err := ix.db.Block(next - 1)
+		if err != nil {
+			return false, err
+		}
+		prevHash := bl.Block.PrevHash()
+		if hex.EncodeToString(prevHash[:]) != prev.Hash {
+			return true, ix.rollback(next - 1)
+		}
+	}
+
+	txs := make([]index.Tx, 0, len(bl.Block.Transactions))
+	for _, txid := range bl.Block.Transactions {
+		tx, err := ix.client.GetTransaction(daemonrpc.GetTransactionRequest{
+			Txid: txid,
+		})
+		if err != nil {
+			return false, fmt.Errorf("transaction %s of block %d: %w", txid, next, err)
+		}
+		txs = append(txs, index.Tx{Txid: txid, Tx: tx})
+	}
+
+	if err := ix.db.AddBlock(bl, txs); err != nil {
+		return false, err
+	}
+
+	if next%1000 == 0 || next == info.Height {
+		ix.log.Info("indexed block", "height", next, "daemon_height", info.Height)
+	}
+
+	return true, nil
+}
+
+// rollback walks back from height until the indexed block matches the daemon's
+// chain, and removes every block above it.
+func (ix *Indexer) rollback(height uint64) error {
+	fork := height
+	for ; fork > 0; fork-- {
+		stored, err := ix.db.Block(fork)
+		if err != nil {
+			return err
+		}
+		bl, err := ix.client.GetBlockByHeight(daemonrpc.GetBlockByHeightRequest{
+			Height: fork,
+		})
+		if err != nil {
+			return err
+		}
+		if bl.Hash == stored.Hash {
+			break
+		}
+	}
+
+	ix.log.Warn("reorg detected", "fork_height", fork, "depth", height-fork)
+
+	return ix.db.Rollback(fork + 1)
+}
+
+// Heights returns the last indexed height and the daemon height seen by the
+// last update.
+func (ix *Indexer) Heights() (indexed, daemon uint64) {
+	next, err := ix.db.Next()
+	if err == nil && next > 0 {
+		indexed = next - 1
+	}
+
+	ix.mut.RLock()
+	defer ix.mut.RUnlock()
+	return indexed, ix.daemonHeight
+}
+
+// Synced reports whether the index is close enough to the daemon tip for
+// address histories to be served from it.
+func (ix *Indexer) Synced() bool {
+	indexed, daemon := ix.Heights()
+	return daemon != 0 && indexed+MAX_DAEMON_LAG >= daemon
+}
+
+func (ix *Indexer) BlockByHeight(height uint64) (*daemonrpc.GetBlockResponse, error) {
+	bl, err := ix.db.Block(height)
+	if err == nil {
+		return bl, nil
+	}
+	if !errors.Is(err, index.ErrNotFound) {
+		ix.log.Error("index lookup failed", "err", err)
+	}
+	return ix.client.GetBlockByHeight(daemonrpc.GetBlockByHeightRequest{Height: height})
+}
+
+func (ix *Indexer) BlockByHash(hash util.Hash) (*daemonrpc.GetBlockResponse, error) {
+	bl, err := ix.db.BlockByHash(hex.EncodeToString(hash[:]))
+	if err == nil {
+		return bl, nil
+	}
+	if !errors.Is(err, index.ErrNotFound) {
+		ix.log.Error("index lookup failed", "err", err)
+	}
+	return ix.client.GetBlockByHash(daemonrpc.GetBlockByHashRequest{Hash: hash})
+}
+
+func (ix *Indexer) Transaction(txid util.Hash) (*daemonrpc.GetTransactionResponse, error) {
+	tx, err := ix.db.Transaction(txid)
+	if err == nil {
+		return tx, nil
+	}
+	if !errors.Is(err, index.ErrNotFound) {
+		ix.log.Error("index lookup failed", "err", err)
+	}
+	// not indexed yet, or still in the mempool
+	return ix.client.GetTransaction(daemonrpc.GetTransactionRequest{Txid: txid})
+}
+
+// ScanBlocks calls fn for every indexed block from the given height up, in
+// height order.
+func (ix *Indexer) ScanBlocks(from uint64, fn func(bl *daemonrpc.GetBlockResponse)) error {
+	return ix.db.ScanBlocks(from, fn)
+}
+
+// HashPrefix returns up to n blocks and transaction ids whose hex hash starts
+// with prefix. ok is false until the index is synced, as the index cannot be
+// searched before.
+func (ix *Indexer) HashPrefix(prefix string, n int) (blocks []*daemonrpc.GetBlockResponse, txids []util.Hash, ok bool) {
+	if !ix.Synced() {
+		return nil, nil, false
+	}
+	blocks, err := ix.db.BlocksByHashPrefix(prefix, n)
+	if err != nil {
+		ix.log.Error("index lookup failed", "err", err)
+		return nil, nil, false
+	}
+	txids, err = ix.db.TxidsByPrefix(prefix, n-len(blocks))
+	if err != nil {
+		ix.log.Error("index lookup failed", "err", err)
+		return nil, nil, false
+	}
+	return blocks, txids, true
+}
+
+// TxList returns a page of the transaction history of an address, from the
+// index once it is synced and from the daemon until then. The first page
+// always comes from the daemon when it answers, as only the daemon knows the
+// transactions still in the mempool.
+func (ix *Indexer) TxList(addr address.Integrated, transferType string, page uint64) (*daemonrpc.GetTxListResponse, error) {
+	req := daemonrpc.GetTxListRequest{
+		Address:      addr,
+		TransferType: transferType,
+		Page:         page,
+	}
+	var daemonErr error
+	if page == 0 || !ix.Synced() {
+		res, err := ix.client.GetTxList(req)
+		if err == nil || !ix.Synced() {
+			return res, err
+		}
+		daemonErr = err
+	}
+
+	txids, maxPage, err := ix.db.AddressTxs(addr.Addr.String(), transferType, page)
+	if err != nil {
+		ix.log.Error("index lookup failed", "err", err)
+		if daemonErr != nil {
+			return nil, daemonErr
+		}
+		return ix.client.GetTxList(req)
+	}
+	return &daemonrpc.GetTxListResponse{
+		Transactions: txids,
+		MaxPage:      maxPage,
+	}, nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// newLogger returns the logger described by the settings. Level and format are
+// checked by Settings.Validate.
+func newLogger(w io.Writer, s *Settings) *slog.Logger {
+	var level slog.Level
+	level.UnmarshalText([]byte(s.LogLevel))
+
+	opts := &slog.HandlerOptions{Level: level}
+	if s.LogFormat == "json" {
+		return slog.New(slog.NewJSONHandler(w, opts))
+	}
+	return slog.New(slog.NewTextHandler(w, opts))
+}
+
+// requestLog returns the HTTP logger annotated with the id of the request.
+func requestLog(c echo.Context) *slog.Logger {
+	return slog.With(
+		"component", "http",
+		"request_id", c.Response().Header().Get(echo.HeaderXRequestID),
+	)
+}
+
+// accessLog logs every request once it is served. Server errors are logged at
+// error level, everything else at debug level.
+var accessLog = middleware.RequestLoggerWithConfig(middleware.RequestLoggerConfig{
+	LogMethod:    true,
+	LogURI:       true,
+	LogStatus:    true,
+	LogLatency:   true,
+	LogRemoteIP:  true,
+	LogRequestID: true,
+	LogValuesFunc: func(c echo.Context, v middleware.RequestLoggerValues) error {
+		level := slog.LevelDebug
+		if v.Status >= 500 {
+			level = slog.LevelError
+		}
+		slog.Log(c.Request().Context(), level, "request",
+			"component", "http",
+			"request_id", v.RequestID,
+			"method", v.Method,
+			"uri", v.URI,
+			"status", v.Status,
+			"latency", v.Latency.Round(time.Microsecond),
+			"remote_ip", v.RemoteIP,
+		)
+		return nil
+	},
+})
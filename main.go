@@ -1,329 +1,250 @@
 package main
 
 import (
-	"cmp"
+	"context"
+	"embed"
 	"encoding/hex"
+	"errors"
+	"flag"
 	"fmt"
-	"math"
+	"io/fs"
+	"log/slog"
 	"net/http"
-	"slices"
-	"sort"
+	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 	"virel-explorer/html"
+	"virel-explorer/index"
+	eutil "virel-explorer/util"
 
-	"github.com/virel-project/virel-blockchain/v3/address"
 	"github.com/virel-project/virel-blockchain/v3/block"
-	"github.com/virel-project/virel-blockchain/v3/chaintype"
 	"github.com/virel-project/virel-blockchain/v3/config"
 	"github.com/virel-project/virel-blockchain/v3/rpc/daemonrpc"
 	"github.com/virel-project/virel-blockchain/v3/util"
 
 	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 const MAX_BLOCKS_HISTORY = 50
 
+const SHUTDOWN_TIMEOUT = 15 * time.Second // time given to open HTTP connections to finish
+
+//go:embed static
+var embeddedStatic embed.FS
+
 func main() {
-	d := daemonrpc.NewRpcClient("http://127.0.0.1:6311")
+	settings, err := LoadSettings(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "invalid configuration:", err)
+		os.Exit(2)
+	}
+
+	slog.SetDefault(newLogger(os.Stderr, settings))
+
+	if err := os.MkdirAll(settings.DataDir, 0o755); err != nil {
+		slog.Error("failed to create the data dir", "err", err)
+		os.Exit(1)
+	}
+
+	html.SetTemplateOverride(settings.TemplateDir)
+	if err := html.LoadTemplates(); err != nil {
+		slog.Error("failed to load templates", "err", err)
+		os.Exit(1)
+	}
+	if settings.Dev {
+		if err := html.WatchTemplates(settings.TemplateDir); err != nil {
+			slog.Error("failed to watch templates", "err", err)
+			os.Exit(1)
+		}
+	}
 
-	bls := NewBlocks(d)
-	go bls.Updater()
+	// stop on SIGINT or SIGTERM: the HTTP server drains its connections,
+	// the updaters finish their current step, then state is flushed
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var wg sync.WaitGroup
+	run := func(f func(context.Context)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f(ctx)
+		}()
+	}
 
-	updater := NewUpdater(d)
-	go updater.Updater()
+	// without an entity file the built-in entities are used, and SIGHUP keeps
+	// its default action
+	if settings.Entities != "" {
+		if err := reloadEntities(settings.Entities); err != nil {
+			os.Exit(1)
+		}
+		run(reloadEntitiesOnHangup(settings.Entities))
+	}
+
+	d := NewDaemonPool(settings.DaemonURLs)
+	run(d.HealthChecker)
+
+	db, err := index.Open(settings.DataPath("index.db"))
+	if err != nil {
+		slog.Error("failed to open the index", "err", err)
+		os.Exit(1)
+	}
+	tip := NewTipService(d)
+	run(tip.Updater)
+
+	ix := NewIndexer(d, tip, db)
+	run(ix.Updater)
+
+	bls, err := NewBlocks(d, tip, db, settings.DataPath("delegates.json"), settings.UptimeWindowDays*config.BLOCKS_PER_DAY)
+	if err != nil {
+		slog.Error("failed to start the block updater", "err", err)
+		os.Exit(1)
+	}
+	run(bls.Updater)
+
+	delegates := NewDelegateService(d, tip, bls)
+	run(delegates.Updater)
+
+	updater := NewUpdater(d, tip)
+	run(updater.Updater)
+
+	ex := &Explorer{
+		client:    d,
+		tip:       tip,
+		blocks:    bls,
+		delegates: delegates,
+		updater:   updater,
+		indexer:   ix,
+
+		txCache:    eutil.NewLRU[util.Hash, *daemonrpc.GetTransactionResponse](TX_CACHE_SIZE),
+		blockTimes: eutil.NewLRU[uint64, string](BLOCK_TIME_CACHE_SIZE),
+		mined:      eutil.NewLRU[string, *minedCache](ENTITY_MINED_CACHE_SIZE),
+	}
+
+	registerMetrics(bls, ix, updater)
 
 	e := echo.New()
+	e.HideBanner = true
+	e.HidePort = true
+	e.Use(middleware.RequestID())
+	e.Use(accessLog)
+	e.Use(httpMetrics)
+
+	e.GET("/metrics", echo.WrapHandler(promhttp.Handler()))
+	registerHealth(ctx, e, ex)
 
 	e.GET("/", func(c echo.Context) error {
-		info, err := d.GetInfo(daemonrpc.GetInfoRequest{})
+		p, err := ex.IndexData()
 		if err != nil {
 			return err
 		}
 
-		return html.Index(c, html.IndexParams{
-			Info:   (*html.InfoRes)(info),
-			Blocks: bls.GetList(),
-		})
+		return html.Index(c, p)
 	})
 	e.GET("/stats", func(c echo.Context) error {
-		updaterOut := updater.Get()
-
-		items := make([]html.RichListItem, len(updaterOut.RichList))
-
-		for i, st := range updaterOut.RichList {
-			items[i] = html.RichListItem{
-				Rank:    i + 1,
-				Address: st.Address,
-				Balance: float64(st.Total()) / config.COIN,
-				Percent: func() float64 {
-					if updaterOut.MarketInfo.Supply == 0 {
-						return 0
-					}
-					return float64(st.Total()) / config.COIN / float64(updaterOut.MarketInfo.Supply) * 100
-				}(),
-			}
-		}
-		info, err := d.GetInfo(daemonrpc.GetInfoRequest{})
+		p, err := ex.StatsData(c.QueryParam("group") == "entity")
 		if err != nil {
 			return err
 		}
 
-		ir := html.InfoRes(*info)
-
-		return html.Stats(c, html.StatsParams{
-			RichList: items,
-			Market:   updaterOut.MarketInfo,
-			Info:     &ir,
-		})
+		return html.Stats(c, p)
 	})
 	e.GET("/staking", func(c echo.Context) error {
-		info, err := d.GetInfo(daemonrpc.GetInfoRequest{})
+		p, err := ex.StakingData()
 		if err != nil {
 			return err
 		}
 
-		ir := html.InfoRes(*info)
-
-		stake := float64(info.Stake) / config.COIN
-
-		reward24h := GetStakeReward(ir.Height, config.BLOCKS_PER_DAY) / stake
-		reward30d := GetStakeReward(ir.Height, 30*config.BLOCKS_PER_DAY) / stake
-		reward60d := GetStakeReward(ir.Height, 60*config.BLOCKS_PER_DAY) / stake
-		reward1y := GetStakeReward(ir.Height, 365*config.BLOCKS_PER_DAY) / stake
-
-		return html.Staking(c, html.StakingParams{
-			Info:      &ir,
-			Reward24h: math.Round(reward24h*10000) / 100,
-			Reward30d: math.Round(reward30d*10000) / 100,
-			Reward60d: math.Round(reward60d*10000) / 100,
-			Reward1y:  math.Round(reward1y*10000) / 100,
-		})
+		return html.Staking(c, p)
 	})
 	e.GET("/delegates.json", func(c echo.Context) error {
-		knownDelegates := bls.GetDelegates()
-
-		info, err := d.GetInfo(daemonrpc.GetInfoRequest{})
+		p, err := ex.DelegatesData()
 		if err != nil {
 			return err
 		}
 
-		ir := html.InfoRes(*info)
-
-		delegs := make([]*html.DelegateInfo, 0, len(knownDelegates))
-
-		for _, v := range knownDelegates {
-			fmt.Println("missed:", v.BlocksMissed, "staked:", v.BlocksStaked)
-			totStaked := max(v.BlocksMissed+v.BlocksStaked, 1)
-
-			addr := address.NewDelegateAddress(v.Id).String()
-
-			delegateInfo, err := d.GetDelegate(daemonrpc.GetDelegateRequest{
-				DelegateAddress: addr,
-			})
-			if err != nil {
-				return err
-			}
-
-			if v.Id != 1 && strings.Contains(strings.ToLower(delegateInfo.Name), "virel.org") {
-				delegateInfo.Name = "delegate"
-			}
-
-			delegs = append(delegs, &html.DelegateInfo{
-				Address:        addr,
-				Description:    delegateInfo.Name,
-				Balance:        float64(delegateInfo.TotalAmount) / config.COIN,
-				BalancePercent: float64(delegateInfo.TotalAmount) / float64(ir.Stake) * 100,
-				UptimePercent:  float64(v.BlocksStaked) / float64(totStaked) * 100,
-			})
-		}
-
-		slices.SortFunc(delegs, func(a, b *html.DelegateInfo) int {
-			return cmp.Compare(b.UptimePercent+b.BalancePercent/8, a.UptimePercent+a.BalancePercent/8)
-		})
-
-		return c.JSON(200, delegs)
+		return c.JSON(200, p.Delegates)
 	})
 	e.GET("/delegates", func(c echo.Context) error {
-		knownDelegates := bls.GetDelegates()
-
-		info, err := d.GetInfo(daemonrpc.GetInfoRequest{})
+		p, err := ex.DelegatesData()
 		if err != nil {
 			return err
 		}
 
-		ir := html.InfoRes(*info)
-
-		delegs := make([]*html.DelegateInfo, 0, len(knownDelegates))
-
-		for _, v := range knownDelegates {
-			fmt.Println("missed:", v.BlocksMissed, "staked:", v.BlocksStaked)
-			totStaked := max(v.BlocksMissed+v.BlocksStaked, 1)
-
-			addr := address.NewDelegateAddress(v.Id).String()
-
-			delegateInfo, err := d.GetDelegate(daemonrpc.GetDelegateRequest{
-				DelegateAddress: addr,
-			})
-			if err != nil {
-				return err
-			}
-
-			if v.Id != 1 && strings.Contains(strings.ToLower(delegateInfo.Name), "virel.org") {
-				delegateInfo.Name = "delegate"
-			}
-
-			delegs = append(delegs, &html.DelegateInfo{
-				Address:        addr,
-				Description:    delegateInfo.Name,
-				Balance:        float64(delegateInfo.TotalAmount) / config.COIN,
-				BalancePercent: float64(delegateInfo.TotalAmount) / float64(ir.Stake) * 100,
-				UptimePercent:  float64(v.BlocksStaked) / float64(totStaked) * 100,
-			})
-		}
-
-		slices.SortFunc(delegs, func(a, b *html.DelegateInfo) int {
-			return cmp.Compare(b.UptimePercent+b.BalancePercent/8, a.UptimePercent+a.BalancePercent/8)
-		})
-
-		return html.Delegates(c, html.DelegatesParams{
-			Delegates: delegs,
-		})
+		return html.Delegates(c, p)
 	})
 	e.GET("/delegate/:id", func(c echo.Context) error {
-		delid := c.Param("id")
-		if len(delid) > 0 && delid[0] != 'd' {
-			delid = "delegate" + delid
-		}
-
-		info, err := d.GetInfo(daemonrpc.GetInfoRequest{})
+		p, err := ex.DelegateData(c.Param("id"))
 		if err != nil {
 			return err
 		}
 
-		deleg, err := d.GetDelegate(daemonrpc.GetDelegateRequest{
-			DelegateAddress: delid,
-		})
+		return html.Delegate(c, p)
+	})
+	e.GET("/delegate/:id/missed", func(c echo.Context) error {
+		p, err := ex.MissedData(c.Param("id"))
 		if err != nil {
-			return c.String(404, "404")
+			return err
 		}
 
-		slices.SortStableFunc(deleg.Funds, func(a, b *chaintype.DelegatedFund) int {
-			return cmp.Compare(b.Amount, a.Amount)
-		})
-
-		funds := make([]*html.Fund, len(deleg.Funds))
-		for i, v := range deleg.Funds {
-			funds[i] = &html.Fund{
-				Owner:  v.Owner,
-				Amount: v.Amount,
-				Unlock: v.Unlock,
-			}
+		return html.Missed(c, p)
+	})
+	e.GET("/entity/:slug", func(c echo.Context) error {
+		p, err := ex.EntityData(c.Request().Context(), c.Param("slug"))
+		if err != nil {
+			return err
 		}
 
-		return html.Delegate(c, &html.DelegateParams{
-			Address: deleg.Address.String(),
-			Info:    deleg,
-			Height:  info.Height,
-			Funds:   funds,
+		return html.EntityPage(c, p)
+	})
+	e.GET("/reorgs", func(c echo.Context) error {
+		return html.Reorgs(c, html.ReorgsParams{
+			Reorgs: bls.GetReorgs(),
 		})
 	})
 
 	e.GET("/block/:bl", func(c echo.Context) error {
-		bl := c.Param("bl")
-
-		var res *daemonrpc.GetBlockResponse
-		var err error
-		if len(bl) == 64 {
-			var hash []byte
-			hash, err = hex.DecodeString(bl)
-			if err != nil {
-				return err
-			}
-
-			res, err = d.GetBlockByHash(daemonrpc.GetBlockByHashRequest{
-				Hash: util.Hash(hash),
-			})
-		} else {
-			var height uint64
-			height, err = strconv.ParseUint(bl, 10, 64)
-			if err != nil {
-				return err
-			}
-
-			res, err = d.GetBlockByHeight(daemonrpc.GetBlockByHeightRequest{
-				Height: height,
-			})
-		}
+		p, err := ex.BlockData(c.Param("bl"))
 		if err != nil {
-			return c.String(500, "failed to find block")
-		}
-		info, err := d.GetInfo(daemonrpc.GetInfoRequest{})
-		if err != nil {
-			return c.String(500, "failed to get info")
-		}
-
-		err = html.Block(c, html.BlockParams{
-			Block: (*html.BlockRes)(res),
-			Info:  info,
-		})
-		if err != nil {
-			fmt.Println(err)
+			return err
 		}
 
-		return err
+		return html.Block(c, p)
 	})
 	e.GET("/tx/:txid", func(c echo.Context) error {
 		txid := c.Param("txid")
 
 		if len(txid) != 32*2 || !util.IsHex(txid) {
-			return c.Redirect(http.StatusMovedPermanently, "/")
+			return fmt.Errorf("%w: invalid transaction id %q", errBadInput, txid)
 		}
 
 		id, _ := hex.DecodeString(txid)
 
-		res, err := d.GetTransaction(daemonrpc.GetTransactionRequest{
-			Txid: [32]byte(id),
-		})
-		if err != nil {
-			fmt.Println(err)
-			return c.Redirect(http.StatusTemporaryRedirect, "/block/"+txid)
-		}
-
-		var confs uint64 = 0
-		if res.Height != 0 && res.Height <= bls.height {
-			confs = bls.height - res.Height + 1
+		p, err := ex.TransactionData(util.Hash(id))
+		if errors.Is(err, errNotFound) {
+			requestLog(c).Debug("transaction not found, trying as a block", "err", err)
+			target := "/block/" + txid
+			if q := c.QueryString(); q != "" {
+				target += "?" + q
+			}
+			return c.Redirect(http.StatusTemporaryRedirect, target)
 		}
-
-		err = html.Transaction(c, html.TransactionParams{
-			Tx:    res,
-			Txid:  txid,
-			Confs: confs,
-		})
 		if err != nil {
-			fmt.Println(err)
+			return err
 		}
 
-		return err
+		return html.Transaction(c, p)
 	})
 	e.GET("/account/:walletaddr", func(c echo.Context) error {
-		walletaddr := c.Param(("walletaddr"))
-
-		addr, err := address.FromString(walletaddr)
-		if err != nil {
-			return err
-		}
-		addr.PaymentId = 0
-
-		addrInfo, err := d.GetAddress(daemonrpc.GetAddressRequest{
-			Address: addr.String(),
-		})
-		if err != nil {
-			return err
-		}
-
-		/* * Transactions * */
-		// Pagination
 		page := uint64(0)
 		if p := c.QueryParam("page"); p != "" {
 			if n, err := strconv.ParseUint(p, 10, 64); err == nil {
@@ -331,138 +252,86 @@ func main() {
 			}
 		}
 
-		// Side
-		transferType := c.QueryParam("transfer_type")
-		if transferType != "incoming" && transferType != "outgoing" {
-			transferType = "incoming"
-		}
-
-		// Transaction hash list
-		txs, err := d.GetTxList(daemonrpc.GetTxListRequest{
-			Address:      addr,
-			TransferType: transferType,
-			Page:         page,
-		})
+		p, err := ex.AccountData(c.Request().Context(), c.Param("walletaddr"), c.QueryParam("transfer_type"), page)
 		if err != nil {
 			return err
 		}
 
-		// Transaction list
-		txList := make([]html.TransactionItem, 0, len(txs.Transactions))
-		for _, id := range txs.Transactions {
-			txRes, err := d.GetTransaction(daemonrpc.GetTransactionRequest{Txid: id})
-			if err != nil {
-				continue
-			}
-
-			txList = append(txList, html.TransactionItem{
-				Tx:   txRes,
-				Txid: id.String(),
-				Amount: func() uint64 {
-					if transferType == "incoming" {
-						var sum uint64
-						for _, o := range txRes.Outputs {
-							if o.Recipient == addr.Addr {
-								sum += o.Amount
-							}
-						}
-						return sum
-					}
-					return txRes.TotalAmount
-				}(),
-			})
-		}
-
-		// Sort them by height
-		sort.Slice(txList, func(a, b int) bool {
-			return txList[a].Tx.Height > txList[b].Tx.Height
-		})
-
-		// For the timestamp of transactions, we need to fetch blocks
-		blockTimes := make(map[uint64]string)
-		for _, tx := range txList {
-			if _, seen := blockTimes[tx.Tx.Height]; seen {
-				continue
-			}
-
-			blkRes, err := d.GetBlockByHeight(daemonrpc.GetBlockByHeightRequest{Height: tx.Tx.Height})
-			if err != nil {
-				continue
-			}
-
-			// Convert Unix timestamp to UTC string
-			blockTimes[tx.Tx.Height] = (*html.BlockRes)(blkRes).UTC()
-		}
-
-		return html.Address(c, html.AddressParams{
-			Info:    addrInfo,
-			Address: walletaddr,
-
-			// Transactions
-			Page:         page,
-			MaxPage:      txs.MaxPage,
-			TransferType: transferType,
-			TxList:       txList,
-			BlockTimes:   blockTimes,
-		})
+		return html.Address(c, p)
 	})
 	e.GET("/search", func(c echo.Context) error {
-		query := strings.Trim(c.QueryParam("q"), " ")
-
-		if len(query) == 64 {
-			hexdata, err := hex.DecodeString(query)
-			if err != nil {
-				return err
-			}
-
-			_, err = d.GetTransaction(daemonrpc.GetTransactionRequest{
-				Txid: util.Hash(hexdata),
-			})
-			if err == nil {
-				return c.Redirect(http.StatusTemporaryRedirect, "/tx/"+query)
-			} else {
-				return c.Redirect(http.StatusTemporaryRedirect, "/block/"+query)
-			}
-		} else if len(query) > 16 {
-			return c.Redirect(http.StatusTemporaryRedirect, "/account/"+query)
+		query := strings.TrimSpace(c.QueryParam("q"))
+		results := ex.Search(query)
+		if len(results) == 1 && !html.WantsJSON(c) {
+			return c.Redirect(http.StatusTemporaryRedirect, results[0].Link)
 		}
-
-		return c.Redirect(http.StatusTemporaryRedirect, "/block/"+query)
+		return html.Search(c, html.SearchParams{
+			Query:   query,
+			Results: results,
+		})
+	})
+	e.GET("/api/search/suggest", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, ex.Suggest(c.QueryParam("q")))
 	})
 	e.GET("/supply", func(c echo.Context) error {
-		infoRes, err := d.GetInfo(daemonrpc.GetInfoRequest{})
+		infoRes, err := ex.info()
 		if err != nil {
 			return err
 		}
 		return c.String(http.StatusOK, fmt.Sprintf("%.2f", float64(infoRes.CirculatingSupply)/float64(infoRes.Coin)))
 	})
 	e.GET("/supply_rest", func(c echo.Context) error {
-		infoRes, err := d.GetInfo(daemonrpc.GetInfoRequest{})
+		infoRes, err := ex.info()
 		if err != nil {
 			return err
 		}
 		return c.JSON(http.StatusOK, map[string]any{"result": fmt.Sprintf("%.2f", float64(infoRes.CirculatingSupply)/float64(infoRes.Coin))})
 	})
 
-	e.Static("/", "./static/")
+	var staticFS fs.FS = echo.MustSubFS(embeddedStatic, "static")
+	if settings.StaticDir != "" {
+		staticFS = eutil.OverlayFS{Upper: os.DirFS(settings.StaticDir), Lower: staticFS}
+	}
+	e.StaticFS("/", staticFS)
+
+	registerAPI(e.Group("/api/v1"), ex)
+	registerAdmin(e, settings)
 
 	e.HTTPErrorHandler = customHTTPErrorHandler
 
-	e.Logger.Fatal(e.Start(":8080"))
-}
-func customHTTPErrorHandler(err error, c echo.Context) {
-	if c.Response().Committed {
-		return
+	go func() {
+		slog.Info("listening", "component", "http", "addr", settings.Listen)
+		if err := e.Start(settings.Listen); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("server stopped", "component", "http", "err", err)
+			stop()
+		}
+	}()
+
+	<-ctx.Done()
+	slog.Info("shutting down")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+	defer cancel()
+	if err := e.Shutdown(shutdownCtx); err != nil {
+		slog.Error("failed to drain connections", "component", "http", "err", err)
 	}
 
-	code := http.StatusInternalServerError
-	if he, ok := err.(*echo.HTTPError); ok {
-		code = he.Code
-	} else {
-		fmt.Println(err)
+	wg.Wait()
+	bls.Flush()
+	if err := db.Close(); err != nil {
+		slog.Error("failed to close the index", "err", err)
 	}
+	slog.Info("stopped")
+}
 
-	c.String(code, fmt.Sprintf("error: %d", code))
+// sleep waits for d, or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+	case <-t.C:
+	}
 }
 
 func GetStakeReward(startHeight, count uint64) float64 {
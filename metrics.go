@@ -0,0 +1,109 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "explorer_http_requests_total",
+		Help: "HTTP requests by route, method and status code.",
+	}, []string{"route", "method", "code"})
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "explorer_http_request_duration_seconds",
+		Help:    "HTTP request latency by route.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	rpcCalls = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "explorer_daemon_rpc_calls_total",
+		Help: "Daemon RPC calls by daemon and method.",
+	}, []string{"daemon", "method"})
+	rpcErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "explorer_daemon_rpc_errors_total",
+		Help: "Failed daemon RPC calls by daemon and method.",
+	}, []string{"daemon", "method"})
+	rpcDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "explorer_daemon_rpc_duration_seconds",
+		Help:    "Daemon RPC latency by daemon and method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"daemon", "method"})
+
+	clockAdjustment = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "explorer_clock_adjustment_milliseconds",
+		Help: "Estimated offset between block timestamps and the local clock, applied to displayed block times.",
+	})
+)
+
+// registerMetrics exports the state of the background updaters.
+func registerMetrics(bls *Blocks, ix *Indexer, updater *Updater) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "explorer_indexed_height",
+		Help: "Height of the last block in the local index.",
+	}, func() float64 {
+		indexed, _ := ix.Heights()
+		return float64(indexed)
+	})
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "explorer_daemon_height",
+		Help: "Daemon chain height seen by the indexer.",
+	}, func() float64 {
+		_, daemon := ix.Heights()
+		return float64(daemon)
+	})
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "explorer_blocks_height",
+		Help: "Height of the last block processed by the block updater.",
+	}, func() float64 {
+		bls.mut.RLock()
+		defer bls.mut.RUnlock()
+		return float64(bls.height)
+	})
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "explorer_market_data_age_seconds",
+		Help: "Time since the market data was last fetched successfully, +Inf if never.",
+	}, func() float64 {
+		t := updater.MarketUpdated()
+		if t.IsZero() {
+			return math.Inf(1)
+		}
+		return time.Since(t).Seconds()
+	})
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "explorer_known_delegates",
+		Help: "Number of delegates seen staking or missing blocks.",
+	}, func() float64 {
+		return float64(bls.DelegateCount())
+	})
+}
+
+// httpMetrics counts requests and measures their latency by route.
+func httpMetrics(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start := time.Now()
+
+		err := next(c)
+		if err != nil {
+			// let the error handler write the response so that its status
+			// code is known
+			c.Error(err)
+		}
+
+		route := c.Path()
+		if route == "" {
+			route = "unmatched"
+		}
+		method := c.Request().Method
+
+		httpRequests.WithLabelValues(route, method, strconv.Itoa(c.Response().Status)).Inc()
+		httpDuration.WithLabelValues(route, method).Observe(time.Since(start).Seconds())
+
+		return nil
+	}
+}
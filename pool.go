@@ -0,0 +1,289 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/virel-project/virel-blockchain/v3/rpc/daemonrpc"
+)
+
+const (
+	HEALTH_CHECK_INTERVAL = 5 * time.Second
+	HEALTH_CHECK_TIMEOUT  = 5 * time.Second
+	RPC_CALL_TIMEOUT      = 10 * time.Second // per daemon tried
+	MAX_DAEMON_LAG        = 2                // blocks a daemon may be behind the best one and still be considered synced
+)
+
+// DaemonPool routes daemon RPC calls to the healthiest of several daemons and
+// fails over to the next one when a call fails.
+type DaemonPool struct {
+	mut   sync.RWMutex
+	nodes []*daemonNode
+	log   *slog.Logger
+}
+
+type daemonNode struct {
+	url    string
+	client *daemonrpc.RpcClient
+
+	// set while the GetInfo of a health check runs, which may outlive
+	// HEALTH_CHECK_TIMEOUT when the daemon hangs
+	checking atomic.Bool
+
+	// updated by the health checks, protected by DaemonPool.mut
+	checked bool
+	healthy bool
+	height  uint64
+	latency time.Duration
+	lastErr error
+}
+
+// DaemonStatus is a snapshot of the health of a daemon of the pool.
+type DaemonStatus struct {
+	URL     string
+	Healthy bool
+	Synced  bool
+	Height  uint64
+	Latency time.Duration
+	Error   string
+}
+
+func NewDaemonPool(urls []string) *DaemonPool {
+	p := &DaemonPool{log: slog.With("component", "pool")}
+	for _, u := range urls {
+		p.nodes = append(p.nodes, &daemonNode{
+			url:    u,
+			client: daemonrpc.NewRpcClient(u),
+		})
+	}
+	return p
+}
+
+// HealthChecker checks the daemons periodically until ctx is done.
+func (p *DaemonPool) HealthChecker(ctx context.Context) {
+	ticker := time.NewTicker(HEALTH_CHECK_INTERVAL)
+	defer ticker.Stop()
+	for {
+		p.check()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// check queries the tip of every daemon concurrently and records its height
+// and latency. A daemon whose previous check has not answered yet is skipped,
+// and stays unhealthy, rather than piling up queries.
+func (p *DaemonPool) check() {
+	var wg sync.WaitGroup
+	for _, n := range p.nodes {
+		if !n.checking.CompareAndSwap(false, true) {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			type result struct {
+				info *daemonrpc.GetInfoResponse
+				err  error
+			}
+			done := make(chan result, 1)
+			start := time.Now()
+			go func() {
+				defer n.checking.Store(false)
+				info, err := n.client.GetInfo(daemonrpc.GetInfoRequest{})
+				done <- result{info, err}
+			}()
+
+			var res result
+			select {
+			case res = <-done:
+			case <-time.After(HEALTH_CHECK_TIMEOUT):
+				res.err = fmt.Errorf("timed out after %s", HEALTH_CHECK_TIMEOUT)
+			}
+			latency := time.Since(start)
+
+			p.mut.Lock()
+			defer p.mut.Unlock()
+
+			if !n.healthy && res.err == nil && n.checked {
+				p.log.Info("daemon is back online", "daemon", n.url)
+			} else if n.healthy && res.err != nil {
+				p.log.Warn("daemon is unhealthy", "daemon", n.url, "err", res.err)
+			}
+			n.checked = true
+			n.lastErr = res.err
+			n.healthy = res.err == nil
+			if res.err == nil {
+				n.height = res.info.Height
+				n.latency = latency
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// ordered returns the daemons in the order they should be tried: healthy and
+// synced daemons by latency first, then the other healthy ones, then the
+// unhealthy ones as a last resort.
+func (p *DaemonPool) ordered() []*daemonNode {
+	p.mut.RLock()
+	defer p.mut.RUnlock()
+
+	tip := p.tipLocked()
+
+	rank := func(n *daemonNode) int {
+		switch {
+		case !n.checked:
+			return 1
+		case !n.healthy:
+			return 2
+		case n.height+MAX_DAEMON_LAG < tip:
+			return 1
+		}
+		return 0
+	}
+
+	nodes := slices.Clone(p.nodes)
+	slices.SortStableFunc(nodes, func(a, b *daemonNode) int {
+		if c := cmp.Compare(rank(a), rank(b)); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.latency, b.latency)
+	})
+	return nodes
+}
+
+func (p *DaemonPool) tipLocked() uint64 {
+	var tip uint64
+	for _, n := range p.nodes {
+		if n.healthy {
+			tip = max(tip, n.height)
+		}
+	}
+	return tip
+}
+
+// Status returns the health of every daemon of the pool.
+func (p *DaemonPool) Status() []DaemonStatus {
+	p.mut.RLock()
+	defer p.mut.RUnlock()
+
+	tip := p.tipLocked()
+
+	out := make([]DaemonStatus, len(p.nodes))
+	for i, n := range p.nodes {
+		out[i] = DaemonStatus{
+			URL:     n.url,
+			Healthy: n.healthy,
+			Synced:  n.healthy && n.height+MAX_DAEMON_LAG >= tip,
+			Height:  n.height,
+			Latency: n.latency,
+		}
+		if n.lastErr != nil {
+			out[i].Error = n.lastErr.Error()
+		}
+	}
+	return out
+}
+
+// markFailed flags a daemon as unhealthy until its next health check.
+func (p *DaemonPool) markFailed(n *daemonNode, err error) {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+
+	if n.healthy {
+		p.log.Warn("daemon failed, switching to another one", "daemon", n.url, "err", err)
+	}
+	n.healthy = false
+	n.lastErr = err
+}
+
+// call runs fn against the best daemon. Transport failures and attempts that
+// take longer than RPC_CALL_TIMEOUT fail over to the next daemon; any other
+// error, such as "not found", is the daemon's answer and is returned at once.
+func call[Req, Res any](p *DaemonPool, method string, fn func(*daemonrpc.RpcClient, Req) (*Res, error), req Req) (*Res, error) {
+	var firstErr error
+	for _, n := range p.ordered() {
+		start := time.Now()
+		res, err := attempt(n, fn, req)
+		rpcCalls.WithLabelValues(n.url, method).Inc()
+		rpcDuration.WithLabelValues(n.url, method).Observe(time.Since(start).Seconds())
+		if err == nil {
+			return res, nil
+		}
+		rpcErrors.WithLabelValues(n.url, method).Inc()
+
+		err = daemonError(err)
+		if !errors.Is(err, errUnavailable) && !errors.Is(err, errTimeout) {
+			return nil, err
+		}
+		p.markFailed(n, err)
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr == nil {
+		return nil, fmt.Errorf("%w: no daemon configured", errUnavailable)
+	}
+	return nil, firstErr
+}
+
+// attempt runs fn against one daemon, giving up after RPC_CALL_TIMEOUT. The
+// RPC client takes no context, so a call given up on finishes in the
+// background.
+func attempt[Req, Res any](n *daemonNode, fn func(*daemonrpc.RpcClient, Req) (*Res, error), req Req) (*Res, error) {
+	type result struct {
+		res *Res
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		res, err := fn(n.client, req)
+		done <- result{res, err}
+	}()
+
+	t := time.NewTimer(RPC_CALL_TIMEOUT)
+	defer t.Stop()
+	select {
+	case r := <-done:
+		return r.res, r.err
+	case <-t.C:
+		return nil, fmt.Errorf("%w: %s did not answer within %s", errTimeout, n.url, RPC_CALL_TIMEOUT)
+	}
+}
+
+func (p *DaemonPool) GetInfo(req daemonrpc.GetInfoRequest) (*daemonrpc.GetInfoResponse, error) {
+	return call(p, "GetInfo", (*daemonrpc.RpcClient).GetInfo, req)
+}
+func (p *DaemonPool) GetBlockByHash(req daemonrpc.GetBlockByHashRequest) (*daemonrpc.GetBlockResponse, error) {
+	return call(p, "GetBlockByHash", (*daemonrpc.RpcClient).GetBlockByHash, req)
+}
+func (p *DaemonPool) GetBlockByHeight(req daemonrpc.GetBlockByHeightRequest) (*daemonrpc.GetBlockResponse, error) {
+	return call(p, "GetBlockByHeight", (*daemonrpc.RpcClient).GetBlockByHeight, req)
+}
+func (p *DaemonPool) GetTransaction(req daemonrpc.GetTransactionRequest) (*daemonrpc.GetTransactionResponse, error) {
+	return call(p, "GetTransaction", (*daemonrpc.RpcClient).GetTransaction, req)
+}
+func (p *DaemonPool) GetAddress(req daemonrpc.GetAddressRequest) (*daemonrpc.GetAddressResponse, error) {
+	return call(p, "GetAddress", (*daemonrpc.RpcClient).GetAddress, req)
+}
+func (p *DaemonPool) GetTxList(req daemonrpc.GetTxListRequest) (*daemonrpc.GetTxListResponse, error) {
+	return call(p, "GetTxList", (*daemonrpc.RpcClient).GetTxList, req)
+}
+func (p *DaemonPool) GetDelegate(req daemonrpc.GetDelegateRequest) (*daemonrpc.GetDelegateResponse, error) {
+	return call(p, "GetDelegate", (*daemonrpc.RpcClient).GetDelegate, req)
+}
+func (p *DaemonPool) GetRichList(req daemonrpc.RichListRequest) (*daemonrpc.RichListResponse, error) {
+	return call(p, "GetRichList", (*daemonrpc.RpcClient).GetRichList, req)
+}
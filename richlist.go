@@ -1,7 +1,8 @@
 package main
 
 import (
-	"fmt"
+	"context"
+	"log/slog"
 	"sync"
 	"time"
 	"virel-explorer/html"
@@ -11,22 +12,30 @@ import (
 
 type Updater struct {
 	mut        sync.RWMutex
-	client     *daemonrpc.RpcClient
+	client     *DaemonPool
+	tip        *TipService
 	list       []daemonrpc.StateInfo
 	marketinfo *html.MarketInfo
+	// time of the last successful update of marketinfo
+	marketUpdated time.Time
 }
 
-func NewUpdater(cl *daemonrpc.RpcClient) *Updater {
-	return &Updater{client: cl}
+func NewUpdater(cl *DaemonPool, tip *TipService) *Updater {
+	return &Updater{client: cl, tip: tip}
 }
 
-func (r *Updater) Updater() {
+// Updater refreshes the rich list and market data every minute until ctx is
+// done.
+func (r *Updater) Updater(ctx context.Context) {
 	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
 	for {
-		if err := r.update(); err != nil {
-			fmt.Println("failed to update rich list:", err)
+		r.update()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
 		}
-		<-ticker.C
 	}
 }
 
@@ -48,25 +57,40 @@ func (r *Updater) Get() UpdaterOutput {
 	}
 }
 
-func (r *Updater) update() error {
-	info, err := r.client.GetInfo(daemonrpc.GetInfoRequest{})
+// update refreshes the rich list and the market data. Either one failing
+// keeps its previous value.
+func (r *Updater) update() {
+	tip, err := r.tip.Get()
 	if err != nil {
-		return err
+		slog.Error("failed to update rich list", "component", "richlist", "err", err)
+		return
 	}
+
 	res, err := r.client.GetRichList(daemonrpc.RichListRequest{})
 	if err != nil {
-		return err
+		slog.Error("failed to update rich list", "component", "richlist", "err", err)
+	} else {
+		r.mut.Lock()
+		r.list = res.Richest
+		r.mut.Unlock()
 	}
 
-	mkt, err := GetMarketInfo(info.CirculatingSupply)
+	mkt, err := GetMarketInfo(tip.Info.CirculatingSupply)
 	if err != nil {
-		return err
+		slog.Error("failed to update market info", "component", "market", "err", err)
+		return
 	}
 
 	r.mut.Lock()
-	r.list = res.Richest
 	r.marketinfo = mkt
+	r.marketUpdated = time.Now()
 	r.mut.Unlock()
+}
 
-	return nil
+// MarketUpdated returns when the market data was last fetched, or the zero time
+// if it never was.
+func (r *Updater) MarketUpdated() time.Time {
+	r.mut.RLock()
+	defer r.mut.RUnlock()
+	return r.marketUpdated
 }
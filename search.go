@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/hex"
+	"slices"
+	"strconv"
+	"strings"
+	"virel-explorer/html"
+
+	"github.com/virel-project/virel-blockchain/v3/address"
+	"github.com/virel-project/virel-blockchain/v3/rpc/daemonrpc"
+	"github.com/virel-project/virel-blockchain/v3/util"
+)
+
+const (
+	SEARCH_MIN_PARTIAL = 6  // shortest hash prefix or name fragment searched for
+	SEARCH_MAX_RESULTS = 50 // results listed on the search page
+	SUGGEST_MAX        = 10
+)
+
+// Search returns every page a query may refer to: a block by height or hash, a
+// transaction, an account, a delegate by address, id or name, or an entity by
+// name. Partial hashes are matched against the index once it is synced, and
+// against the recent blocks and their transactions until then.
+func (ex *Explorer) Search(query string) []html.SearchResult {
+	q := strings.TrimSpace(query)
+	if q == "" {
+		return nil
+	}
+	lower := strings.ToLower(q)
+
+	var results []html.SearchResult
+	add := func(r html.SearchResult) {
+		if len(results) >= SEARCH_MAX_RESULTS {
+			return
+		}
+		if !slices.ContainsFunc(results, func(v html.SearchResult) bool { return v.Link == r.Link }) {
+			results = append(results, r)
+		}
+	}
+
+	// without delegate records yet, delegates are simply not searched
+	delegates, _ := ex.delegates.Get()
+
+	// height, and delegate id
+	if n, err := strconv.ParseUint(q, 10, 64); err == nil && strconv.FormatUint(n, 10) == q {
+		if info, err := ex.info(); err == nil && n <= info.Height {
+			add(html.SearchResult{Kind: "Block", Title: "Block " + q, Link: "/block/" + q})
+		}
+	}
+	if id, err := strconv.ParseUint(strings.TrimPrefix(lower, "delegate"), 10, 64); err == nil && len(q) <= len("delegate")+20 {
+		addr := address.NewDelegateAddress(id).String()
+		for _, d := range delegates {
+			if d.Address == addr {
+				add(delegateResult(d))
+			}
+		}
+	}
+
+	// block hash and transaction id
+	if len(q) == 64 && util.IsHex(q) {
+		hash, _ := hex.DecodeString(q)
+		if bl, err := ex.indexer.BlockByHash(util.Hash(hash)); err == nil {
+			add(html.SearchResult{Kind: "Block", Title: "Block " + strconv.FormatUint(bl.Block.Height, 10), Link: "/block/" + lower, Detail: lower})
+		}
+		if _, err := ex.indexer.Transaction(util.Hash(hash)); err == nil {
+			add(html.SearchResult{Kind: "Transaction", Title: "Transaction", Link: "/tx/" + lower, Detail: lower})
+		}
+	} else if len(q) >= SEARCH_MIN_PARTIAL && len(q) < 64 && util.IsHex(q) {
+		for _, r := range ex.hashPrefix(lower, SEARCH_MAX_RESULTS) {
+			add(r)
+		}
+	}
+
+	// delegate address and account
+	for _, d := range delegates {
+		if strings.EqualFold(d.Address, q) {
+			add(delegateResult(d))
+		}
+	}
+	if !strings.HasPrefix(lower, "delegate") {
+		if addr, err := address.FromString(q); err == nil {
+			addr.PaymentId = 0
+			s := addr.String()
+			add(html.SearchResult{Kind: "Account", Title: accountTitle(s), Link: "/account/" + s, Detail: s})
+		}
+	}
+
+	// delegate names and entity labels
+	if len(q) >= 2 {
+		for _, d := range delegates {
+			if d.Description != "" && strings.Contains(strings.ToLower(d.Description), lower) {
+				add(delegateResult(d))
+			}
+		}
+		for _, e := range html.AllEntities() {
+			if !strings.Contains(strings.ToLower(e.Name), lower) {
+				continue
+			}
+			add(html.SearchResult{Kind: "Entity", Title: e.Name + " (" + e.Category + ")", Link: "/entity/" + e.Slug, Detail: strings.Join(e.Addresses, ", ")})
+		}
+	}
+
+	return results
+}
+
+// Suggest returns completions of a partial query: recent block heights, block
+// hashes and transaction ids, delegate names, entity labels and the addresses
+// of the rich list.
+func (ex *Explorer) Suggest(query string) []apiSuggestion {
+	q := strings.TrimSpace(query)
+	if q == "" {
+		return []apiSuggestion{}
+	}
+	lower := strings.ToLower(q)
+
+	out := make([]apiSuggestion, 0, SUGGEST_MAX)
+	add := func(s apiSuggestion) bool {
+		if len(out) >= SUGGEST_MAX {
+			return false
+		}
+		out = append(out, s)
+		return true
+	}
+
+	// recent heights, most recent first
+	if _, err := strconv.ParseUint(q, 10, 64); err == nil {
+		for _, bl := range ex.blocks.GetList() {
+			if h := strconv.FormatUint(bl.Block.Height, 10); strings.HasPrefix(h, q) && !add(apiSuggestion{Kind: "Block", Value: h, Link: "/block/" + h}) {
+				return out
+			}
+		}
+	}
+	if len(q) < 2 {
+		return out
+	}
+
+	if len(q) >= SEARCH_MIN_PARTIAL && len(q) < 64 && util.IsHex(q) {
+		for _, r := range ex.hashPrefix(lower, SUGGEST_MAX) {
+			if !add(apiSuggestion{Kind: r.Kind, Value: r.Detail, Detail: r.Title, Link: r.Link}) {
+				return out
+			}
+		}
+	}
+
+	delegates, _ := ex.delegates.Get()
+	for _, d := range delegates {
+		if d.Description == "" || !strings.Contains(strings.ToLower(d.Description), lower) {
+			continue
+		}
+		if !add(apiSuggestion{Kind: "Delegate", Value: d.Description, Detail: d.Address, Link: "/delegate/" + d.Address}) {
+			return out
+		}
+	}
+
+	for _, e := range html.AllEntities() {
+		if strings.Contains(strings.ToLower(e.Name), lower) && !add(apiSuggestion{Kind: "Entity", Value: e.Name, Detail: e.Category, Link: "/entity/" + e.Slug}) {
+			return out
+		}
+	}
+
+	for _, st := range ex.updater.Get().RichList {
+		if strings.HasPrefix(st.Address, lower) && !add(apiSuggestion{Kind: "Account", Value: st.Address, Detail: entityName(st.Address), Link: "/account/" + st.Address}) {
+			return out
+		}
+	}
+
+	return out
+}
+
+// hashPrefix returns up to n blocks and transactions whose hash starts with the
+// lowercase hex prefix: from the index once it is synced, otherwise from the
+// recent blocks.
+func (ex *Explorer) hashPrefix(prefix string, n int) []html.SearchResult {
+	var out []html.SearchResult
+	addBlock := func(bl *daemonrpc.GetBlockResponse) {
+		out = append(out, html.SearchResult{Kind: "Block", Title: "Block " + strconv.FormatUint(bl.Block.Height, 10), Link: "/block/" + bl.Hash, Detail: bl.Hash})
+	}
+	addTx := func(txid util.Hash) {
+		id := txid.String()
+		out = append(out, html.SearchResult{Kind: "Transaction", Title: "Transaction", Link: "/tx/" + id, Detail: id})
+	}
+
+	if blocks, txids, ok := ex.indexer.HashPrefix(prefix, n); ok {
+		for _, bl := range blocks {
+			addBlock(bl)
+		}
+		for _, txid := range txids {
+			addTx(txid)
+		}
+		return out
+	}
+
+	for _, bl := range ex.blocks.GetList() {
+		if len(out) < n && strings.HasPrefix(bl.Hash, prefix) {
+			addBlock(bl)
+		}
+		for _, txid := range bl.Block.Transactions {
+			if len(out) < n && strings.HasPrefix(txid.String(), prefix) {
+				addTx(txid)
+			}
+		}
+	}
+	return out
+}
+
+func delegateResult(d *html.DelegateInfo) html.SearchResult {
+	title := "Delegate " + d.Address
+	if d.Description != "" {
+		title += " (" + d.Description + ")"
+	}
+	return html.SearchResult{Kind: "Delegate", Title: title, Link: "/delegate/" + d.Address, Detail: d.Address}
+}
+
+func accountTitle(addr string) string {
+	if e := html.LookupEntity(addr); e != nil {
+		return "Account " + e.Name
+	}
+	return "Account"
+}
+
+func entityName(addr string) string {
+	if e := html.LookupEntity(addr); e != nil {
+		return e.Name
+	}
+	return ""
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const envPrefix = "VIREL_EXPLORER_"
+
+// Settings is the runtime configuration of the explorer.
+//
+// Values are resolved in this order, each step overriding the previous one:
+// built-in defaults, the YAML configuration file, environment variables and
+// command line flags.
+type Settings struct {
+	DaemonURLs  []string `yaml:"daemon_urls"`  // daemon RPC endpoints, see DaemonPool
+	Listen      string   `yaml:"listen"`       // HTTP listen address
+	DataDir     string   `yaml:"data_dir"`     // directory for persisted state (delegates.json, ...)
+	TemplateDir string   `yaml:"template_dir"` // optional directory overriding the embedded HTML templates
+	StaticDir   string   `yaml:"static_dir"`   // optional directory overriding the embedded static assets
+	Dev         bool     `yaml:"dev"`          // reload templates from TemplateDir when they change
+	LogLevel    string   `yaml:"log_level"`    // debug, info, warn or error
+	LogFormat   string   `yaml:"log_format"`   // text or json
+	Entities    string   `yaml:"entities"`     // optional YAML file or directory of entity labels
+	AdminToken  string   `yaml:"admin_token"`  // bearer token of the /admin endpoints, disabled if empty
+
+	UptimeWindowDays uint64 `yaml:"uptime_window_days"` // days of history scanned for delegate uptime on a fresh start
+}
+
+func DefaultSettings() *Settings {
+	return &Settings{
+		DaemonURLs: []string{"http://127.0.0.1:6311"},
+		Listen:     ":8080",
+		DataDir:    ".",
+		LogLevel:   "info",
+		LogFormat:  "text",
+
+		UptimeWindowDays: 30,
+	}
+}
+
+type settingVar struct {
+	name  string // flag name, also used to derive the environment variable name
+	usage string
+	value func(s *Settings) flag.Value
+}
+
+var settingVars = []settingVar{
+	{"daemon-urls", "comma-separated daemon RPC URLs", func(s *Settings) flag.Value { return (*listValue)(&s.DaemonURLs) }},
+	{"listen", "HTTP listen address", func(s *Settings) flag.Value { return (*stringValue)(&s.Listen) }},
+	{"data-dir", "directory for persisted explorer state", func(s *Settings) flag.Value { return (*stringValue)(&s.DataDir) }},
+	{"template-dir", "directory overriding the embedded HTML templates", func(s *Settings) flag.Value { return (*stringValue)(&s.TemplateDir) }},
+	{"static-dir", "directory overriding the embedded static assets", func(s *Settings) flag.Value { return (*stringValue)(&s.StaticDir) }},
+	{"dev", "development mode: reload templates when they change", func(s *Settings) flag.Value { return (*boolValue)(&s.Dev) }},
+	{"log-level", "minimum log level: debug, info, warn or error", func(s *Settings) flag.Value { return (*stringValue)(&s.LogLevel) }},
+	{"log-format", "log output format: text or json", func(s *Settings) flag.Value { return (*stringValue)(&s.LogFormat) }},
+	{"entities", "YAML file or directory of entity labels (built-in labels if empty)", func(s *Settings) flag.Value { return (*stringValue)(&s.Entities) }},
+	{"admin-token", "bearer token enabling the /admin endpoints", func(s *Settings) flag.Value { return (*stringValue)(&s.AdminToken) }},
+	{"uptime-window-days", "days of chain history scanned for delegate uptime on a fresh start (0 disables)", func(s *Settings) flag.Value { return (*uintValue)(&s.UptimeWindowDays) }},
+}
+
+type stringValue string
+
+func (v *stringValue) String() string { return string(*v) }
+func (v *stringValue) Set(s string) error {
+	*v = stringValue(s)
+	return nil
+}
+
+// listValue is a comma-separated list. Setting it replaces the whole list.
+type listValue []string
+
+func (v *listValue) String() string { return strings.Join(*v, ",") }
+func (v *listValue) Set(s string) error {
+	*v = nil
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*v = append(*v, item)
+		}
+	}
+	return nil
+}
+
+type uintValue uint64
+
+func (v *uintValue) String() string { return strconv.FormatUint(uint64(*v), 10) }
+func (v *uintValue) Set(s string) error {
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return err
+	}
+	*v = uintValue(n)
+	return nil
+}
+
+type boolValue bool
+
+func (v *boolValue) String() string   { return strconv.FormatBool(bool(*v)) }
+func (v *boolValue) IsBoolFlag() bool { return true }
+func (v *boolValue) Set(s string) error {
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	*v = boolValue(b)
+	return nil
+}
+
+// envName returns the environment variable for a flag name, e.g.
+// "data-dir" -> "VIREL_EXPLORER_DATA_DIR".
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// LoadSettings builds the settings from the configuration file, the environment
+// and the given command line arguments, then validates them.
+func LoadSettings(args []string) (*Settings, error) {
+	s := DefaultSettings()
+
+	fs := flag.NewFlagSet("virel-explorer", flag.ContinueOnError)
+	configPath := fs.String("config", os.Getenv(envName("config")), "path to a YAML configuration file (env "+envName("config")+")")
+	for _, v := range settingVars {
+		fs.Var(v.value(s), v.name, v.usage+" (env "+envName(v.name)+")")
+	}
+
+	// The flags are parsed twice: first to find the configuration file, then
+	// again after the file and the environment are applied, so that flags
+	// always have the last word.
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	*s = *DefaultSettings()
+	if *configPath != "" {
+		if err := s.loadFile(*configPath); err != nil {
+			return nil, err
+		}
+	}
+	for _, v := range settingVars {
+		if env, ok := os.LookupEnv(envName(v.name)); ok {
+			if err := v.value(s).Set(env); err != nil {
+				return nil, fmt.Errorf("%s: %w", envName(v.name), err)
+			}
+		}
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Settings) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+	defer f.Close()
+
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(s); err != nil {
+		return fmt.Errorf("config %s: %w", path, err)
+	}
+	return nil
+}
+
+// Validate checks the settings. It has no side effect but filling in defaults
+// that depend on other settings.
+func (s *Settings) Validate() error {
+	if len(s.DaemonURLs) == 0 {
+		return errors.New("at least one daemon url is required")
+	}
+	for i, d := range s.DaemonURLs {
+		u, err := url.Parse(d)
+		if err != nil {
+			return fmt.Errorf("invalid daemon url %q: %w", d, err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid daemon url %q: expected http(s)://host:port", d)
+		}
+		if slices.Contains(s.DaemonURLs[:i], d) {
+			return fmt.Errorf("duplicate daemon url %q", d)
+		}
+	}
+
+	_, port, err := net.SplitHostPort(s.Listen)
+	if err != nil {
+		return fmt.Errorf("invalid listen address %q: %w", s.Listen, err)
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return fmt.Errorf("invalid listen address %q: bad port", s.Listen)
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(s.LogLevel)); err != nil {
+		return fmt.Errorf("invalid log level %q", s.LogLevel)
+	}
+	if s.LogFormat != "text" && s.LogFormat != "json" {
+		return fmt.Errorf("invalid log format %q: expected text or json", s.LogFormat)
+	}
+
+	if s.DataDir == "" {
+		return errors.New("data dir must not be empty")
+	}
+	if st, err := os.Stat(s.DataDir); err == nil && !st.IsDir() {
+		return fmt.Errorf("data dir %q is not a directory", s.DataDir)
+	}
+
+	if s.Entities != "" {
+		if _, err := os.Stat(s.Entities); err != nil {
+			return fmt.Errorf("entities: %w", err)
+		}
+	}
+
+	// dev mode watches the templates on disk, by default those of the
+	// source tree
+	if s.Dev && s.TemplateDir == "" {
+		s.TemplateDir = "./html/templates/"
+	}
+
+	for name, dir := range map[string]string{"template dir": s.TemplateDir, "static dir": s.StaticDir} {
+		if dir == "" {
+			continue
+		}
+		st, err := os.Stat(dir)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if !st.IsDir() {
+			return fmt.Errorf("%s %q is not a directory", name, dir)
+		}
+	}
+
+	return nil
+}
+
+// DataPath returns the path of a file in the data directory.
+func (s *Settings) DataPath(name string) string {
+	return filepath.Join(s.DataDir, name)
+}
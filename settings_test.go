@@ -0,0 +1,74 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadSettingsPrecedence(t *testing.T) {
+	dir := t.TempDir()
+	config := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(config, []byte("listen: \":1001\"\nlog_level: warn\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		env    map[string]string
+		args   []string
+		listen string
+	}{
+		{"defaults", nil, nil, ":8080"},
+		{"file", nil, []string{"-config", config}, ":1001"},
+		{"env over file", map[string]string{"VIREL_EXPLORER_LISTEN": ":1002"}, []string{"-config", config}, ":1002"},
+		{"flag over env", map[string]string{"VIREL_EXPLORER_LISTEN": ":1002"}, []string{"-config", config, "-listen", ":1003"}, ":1003"},
+		{"config from env", map[string]string{"VIREL_EXPLORER_CONFIG": config}, nil, ":1001"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			s, err := LoadSettings(tt.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s.Listen != tt.listen {
+				t.Errorf("listen = %q, want %q", s.Listen, tt.listen)
+			}
+		})
+	}
+}
+
+func TestLoadSettingsInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{"no daemon", []string{"-daemon-urls", ""}},
+		{"bad daemon scheme", []string{"-daemon-urls", "ftp://127.0.0.1:6311"}},
+		{"duplicate daemon", []string{"-daemon-urls", "http://a:1,http://a:1"}},
+		{"bad port", []string{"-listen", ":99999"}},
+		{"bad log level", []string{"-log-level", "loud"}},
+		{"bad log format", []string{"-log-format", "xml"}},
+		{"unknown flag", []string{"-nope"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := LoadSettings(tt.args); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestValidateCreatesNothing(t *testing.T) {
+	dataDir := filepath.Join(t.TempDir(), "data")
+	if _, err := LoadSettings([]string{"-data-dir", dataDir}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dataDir); !os.IsNotExist(err) {
+		t.Errorf("data dir was created by validation: %v", err)
+	}
+}
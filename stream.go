@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const STREAM_KEEPALIVE = 15 * time.Second
+
+// streamBlocks sends new blocks to the client as Server-Sent Events, until the
+// client goes away or the updater stops. A "block" event carries an
+// apiBlockEvent; a "reorg" event carries an html.ReorgInfo, after which the
+// blocks already sent may no longer be in the main chain.
+func streamBlocks(c echo.Context, bls *Blocks) error {
+	events, unsubscribe := bls.Subscribe()
+	defer unsubscribe()
+
+	w := c.Response()
+	w.Header().Set(echo.HeaderContentType, "text/event-stream")
+	w.Header().Set(echo.HeaderCacheControl, "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // disable proxy buffering
+	w.WriteHeader(http.StatusOK)
+	w.Flush()
+
+	keepalive := time.NewTicker(STREAM_KEEPALIVE)
+	defer keepalive.Stop()
+
+	for {
+		var err error
+		select {
+		case <-c.Request().Context().Done():
+			return nil
+		case <-keepalive.C:
+			_, err = fmt.Fprint(w, ": keepalive\n\n")
+		case ev, ok := <-events:
+			if !ok {
+				return nil
+			}
+			if ev.Block != nil {
+				err = writeEvent(w, "block", newAPIBlockEvent(ev.Block))
+			} else {
+				err = writeEvent(w, "reorg", ev.Reorg)
+			}
+		}
+		if err != nil {
+			return nil // the client went away
+		}
+		w.Flush()
+	}
+}
+
+func writeEvent(w *echo.Response, name string, data any) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, b)
+	return err
+}
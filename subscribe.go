@@ -0,0 +1,62 @@
+package main
+
+import (
+	"virel-explorer/html"
+
+	"github.com/virel-project/virel-blockchain/v3/rpc/daemonrpc"
+)
+
+const SUBSCRIBER_BUFFER = 16 // events a subscriber may lag behind before it is dropped
+
+// BlockEvent is sent to subscribers for every block appended by the updater,
+// and for every reorganisation.
+type BlockEvent struct {
+	Block *daemonrpc.GetBlockResponse // new block, nil for a reorg
+	Reorg *html.ReorgInfo             // reorganisation, nil for a block
+}
+
+// Subscribe returns a channel receiving block events, and a function to
+// unsubscribe. The channel is closed when the subscriber falls too far behind
+// or the updater stops, and must then be subscribed again.
+func (b *Blocks) Subscribe() (<-chan BlockEvent, func()) {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+
+	ch := make(chan BlockEvent, SUBSCRIBER_BUFFER)
+	if b.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	b.subs[ch] = struct{}{}
+
+	return ch, func() {
+		b.mut.Lock()
+		defer b.mut.Unlock()
+		if _, ok := b.subs[ch]; ok {
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// publish sends an event to every subscriber. It is called with b.mut held.
+func (b *Blocks) publish(ev BlockEvent) {
+	for ch := range b.subs {
+		select {
+		case ch <- ev:
+		default:
+			// a slow subscriber must not hold the updater back
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// closeSubscribers closes every subscription. It is called with b.mut held.
+func (b *Blocks) closeSubscribers() {
+	for ch := range b.subs {
+		delete(b.subs, ch)
+		close(ch)
+	}
+	b.closed = true
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/virel-project/virel-blockchain/v3/rpc/daemonrpc"
+)
+
+const TIP_REFRESH_INTERVAL = 5 * time.Second
+
+// Tip is a snapshot of the chain tip. It is never modified once published, so
+// a page built from one snapshot shows a consistent height.
+type Tip struct {
+	Info    *daemonrpc.GetInfoResponse
+	Block   *daemonrpc.GetBlockResponse // block at Info.Height
+	Fetched time.Time
+}
+
+// TipService keeps the latest chain tip snapshot, so that the updaters and the
+// pages share one GetInfo call. The block updater publishes each new tip block
+// it sees; in between, for instance while it catches up, the snapshot is
+// refreshed from the daemon.
+type TipService struct {
+	client *DaemonPool
+	tip    atomic.Pointer[Tip]
+	notify chan struct{}
+	log    *slog.Logger
+}
+
+func NewTipService(cl *DaemonPool) *TipService {
+	return &TipService{
+		client: cl,
+		notify: make(chan struct{}, 1),
+		log:    slog.With("component", "tip"),
+	}
+}
+
+// Updater refreshes the snapshot until ctx is done.
+func (t *TipService) Updater(ctx context.Context) {
+	ticker := time.NewTicker(TIP_REFRESH_INTERVAL)
+	defer ticker.Stop()
+	for {
+		// a snapshot published by the block updater is fresh enough
+		if tip := t.tip.Load(); tip == nil || time.Since(tip.Fetched) >= TIP_REFRESH_INTERVAL {
+			if _, err := t.refresh(); err != nil {
+				t.log.Error("failed to refresh the chain tip", "err", err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-t.notify:
+		}
+	}
+}
+
+// Publish makes a tip seen by the block updater the current snapshot.
+func (t *TipService) Publish(info *daemonrpc.GetInfoResponse, bl *daemonrpc.GetBlockResponse) {
+	t.tip.Store(&Tip{Info: info, Block: bl, Fetched: time.Now()})
+}
+
+// Notify asks for a refresh, e.g. after a reorg.
+func (t *TipService) Notify() {
+	select {
+	case t.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Get returns the latest snapshot. Until the first refresh succeeds, it
+// fetches the tip itself.
+func (t *TipService) Get() (*Tip, error) {
+	if tip := t.tip.Load(); tip != nil {
+		return tip, nil
+	}
+	return t.refresh()
+}
+
+func (t *TipService) refresh() (*Tip, error) {
+	info, err := t.client.GetInfo(daemonrpc.GetInfoRequest{})
+	if err != nil {
+		return nil, err
+	}
+
+	bl, err := t.client.GetBlockByHeight(daemonrpc.GetBlockByHeightRequest{
+		Height: info.Height,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	tip := &Tip{
+		Info:    info,
+		Block:   bl,
+		Fetched: time.Now(),
+	}
+	t.tip.Store(tip)
+	return tip, nil
+}
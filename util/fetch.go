@@ -0,0 +1,78 @@
+package util
+
+import (
+	"context"
+	"sync"
+)
+
+// FetchResult is the outcome of fetching one item with FetchAll.
+type FetchResult[V any] struct {
+	Value V
+	Err   error
+}
+
+// FetchAll calls fetch for every key with at most workers calls in flight, and
+// returns the results in the order of keys. Keys not fetched by the time ctx
+// is done get ctx's error; calls still running then are left to finish in the
+// background and their results are dropped.
+func FetchAll[K, V any](ctx context.Context, keys []K, workers int, fetch func(K) (V, error)) []FetchResult[V] {
+	type done struct {
+		i   int
+		res FetchResult[V]
+	}
+
+	results := make([]FetchResult[V], len(keys))
+	fetched := make([]bool, len(keys))
+
+	// buffered so that workers never block on a caller that stopped waiting
+	out := make(chan done, len(keys))
+	next := make(chan int)
+
+	var wg sync.WaitGroup
+	for range min(workers, len(keys)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				v, err := fetch(keys[i])
+				out <- done{i, FetchResult[V]{v, err}}
+			}
+		}()
+	}
+
+	go func() {
+		defer close(next)
+		for i := range keys {
+			select {
+			case next <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+
+collect:
+	for {
+		select {
+		case d, ok := <-out:
+			if !ok {
+				break collect
+			}
+			results[d.i] = d.res
+			fetched[d.i] = true
+		case <-ctx.Done():
+			break collect
+		}
+	}
+
+	for i := range results {
+		if !fetched[i] {
+			results[i].Err = ctx.Err()
+		}
+	}
+	return results
+}
@@ -0,0 +1,58 @@
+package util
+
+import (
+	"container/list"
+	"sync"
+)
+
+// LRU is a fixed-size cache that evicts the least recently used entry. It is
+// safe for concurrent use.
+type LRU[K comparable, V any] struct {
+	mut   sync.Mutex
+	size  int
+	order *list.List // front is the most recently used
+	items map[K]*list.Element
+}
+
+type lruEntry[K comparable, V any] struct {
+	key   K
+	value V
+}
+
+func NewLRU[K comparable, V any](size int) *LRU[K, V] {
+	return &LRU[K, V]{
+		size:  size,
+		order: list.New(),
+		items: make(map[K]*list.Element, size),
+	}
+}
+
+func (l *LRU[K, V]) Get(key K) (value V, ok bool) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	el, ok := l.items[key]
+	if !ok {
+		return value, false
+	}
+	l.order.MoveToFront(el)
+	return el.Value.(*lruEntry[K, V]).value, true
+}
+
+func (l *LRU[K, V]) Add(key K, value V) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	if el, ok := l.items[key]; ok {
+		el.Value.(*lruEntry[K, V]).value = value
+		l.order.MoveToFront(el)
+		return
+	}
+
+	l.items[key] = l.order.PushFront(&lruEntry[K, V]{key, value})
+	if l.order.Len() > l.size {
+		oldest := l.order.Back()
+		l.order.Remove(oldest)
+		delete(l.items, oldest.Value.(*lruEntry[K, V]).key)
+	}
+}
@@ -0,0 +1,27 @@
+package util
+
+import (
+	"errors"
+	"io/fs"
+)
+
+// OverlayFS serves files from Upper when they exist there, and falls back to
+// Lower otherwise. It lets an on-disk directory override single files of an
+// embedded file system.
+type OverlayFS struct {
+	Upper fs.FS
+	Lower fs.FS
+}
+
+func (o OverlayFS) Open(name string) (fs.File, error) {
+	if o.Upper != nil {
+		f, err := o.Upper.Open(name)
+		if err == nil {
+			return f, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+	return o.Lower.Open(name)
+}